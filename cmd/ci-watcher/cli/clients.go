@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"context"
+	"sync"
+
+	"github.com/davarch/ci-watcher/internal/infrastructure/config"
+	"github.com/davarch/ci-watcher/internal/infrastructure/gitlab_http"
+)
+
+// clientCache keeps one GitLab client per instance across config reloads,
+// so saving the config (e.g. by enable) keeps ETags, resolved projects and
+// the current user, and does not re-run token_command.
+type clientCache struct {
+	mu      sync.Mutex
+	clients map[string]cachedClient
+}
+
+type cachedClient struct {
+	in    config.GitLab
+	token string
+	gl    *gitlab_http.Client
+}
+
+func newClientCache() *clientCache {
+	return &clientCache{clients: make(map[string]cachedClient)}
+}
+
+// update returns a client for every instance, reusing those whose settings
+// are unchanged, and forgets instances no longer configured. A token_file
+// is re-read, so rotating it takes effect on reload.
+func (c *clientCache) update(ctx context.Context, ins []config.GitLab) (map[string]*gitlab_http.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next := make(map[string]cachedClient, len(ins))
+	out := make(map[string]*gitlab_http.Client, len(ins))
+	for _, in := range ins {
+		old, ok := c.clients[in.Name]
+		same := ok && old.in == in
+		if same && (in.Token != "" || in.TokenFile == "") {
+			next[in.Name], out[in.Name] = old, old.gl
+			continue
+		}
+
+		token, err := in.ResolveToken(ctx)
+		if err != nil {
+			return nil, instanceErr(in, err)
+		}
+		if same && token == old.token {
+			next[in.Name], out[in.Name] = old, old.gl
+			continue
+		}
+
+		gl, err := gitlab_http.NewWithTransport(in.BaseURL, token, in.Timeout, gitlab_http.Transport{
+			CAFile:             in.CAFile,
+			CertFile:           in.CertFile,
+			KeyFile:            in.KeyFile,
+			InsecureSkipVerify: in.InsecureSkipVerify,
+			ProxyURL:           in.ProxyURL,
+		})
+		if err != nil {
+			return nil, instanceErr(in, err)
+		}
+		next[in.Name] = cachedClient{in: in, token: token, gl: gl}
+		out[in.Name] = gl
+	}
+
+	c.clients = next
+	return out, nil
+}
@@ -0,0 +1,185 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/application"
+	"github.com/davarch/ci-watcher/internal/infrastructure/cache_fs"
+	"github.com/davarch/ci-watcher/internal/infrastructure/config"
+	"github.com/davarch/ci-watcher/internal/infrastructure/control_unix"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	ctlSocket string
+	ctlJSON   bool
+)
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Control a running daemon over its socket",
+}
+
+func init() {
+	ctlCmd.PersistentFlags().StringVar(&ctlSocket, "socket", "", "control socket path (default from config or $XDG_RUNTIME_DIR/ci-watcher.sock)")
+
+	simple := func(use, short, cmd string) *cobra.Command {
+		return &cobra.Command{
+			Use:   use,
+			Short: short,
+			Args:  cobra.NoArgs,
+			RunE: func(c *cobra.Command, args []string) error {
+				_, err := ctlCall(c.Context(), control_unix.Request{Cmd: cmd})
+				return err
+			},
+		}
+	}
+
+	pollCmd := &cobra.Command{
+		Use:   "poll [project]",
+		Short: "Poll all projects (or one by name, id or id:ref) right now",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(c *cobra.Command, args []string) error {
+			req := control_unix.Request{Cmd: control_unix.CmdPoll}
+			if len(args) == 1 {
+				req.Project = args[0]
+			}
+			_, err := ctlCall(c.Context(), req)
+			return err
+		},
+	}
+	pollCmd.ValidArgsFunction = enableCmd.ValidArgsFunction
+
+	openCmd := &cobra.Command{
+		Use:   "open",
+		Short: "Open the pipeline in the worst status in the browser",
+		Long: "Open the pipeline in the worst status with xdg-open. It reads the status " +
+			"cache, so it runs in the caller's session and works without the daemon.",
+		Args: cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			cfg, err := config.Load(cfgPath)
+			if err != nil && !errors.Is(err, config.ErrNoToken) {
+				return err
+			}
+			f, err := cache_fs.Read(cfg.Cache.Path)
+			if err != nil {
+				return err
+			}
+			url := f.WorstURL()
+			if url == "" {
+				return errors.New("no pipeline to open")
+			}
+			return exec.CommandContext(c.Context(), "xdg-open", url).Run()
+		},
+	}
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Print daemon status",
+		Args:  cobra.NoArgs,
+		RunE: func(c *cobra.Command, args []string) error {
+			resp, err := ctlCall(c.Context(), control_unix.Request{Cmd: control_unix.CmdStatus})
+			if err != nil {
+				return err
+			}
+
+			var st application.Status
+			if err := json.Unmarshal(resp.Result, &st); err != nil {
+				return err
+			}
+
+			if ctlJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(st)
+			}
+
+			fmt.Printf("paused: %t\n", st.Paused)
+			fmt.Printf("quiet: %t\n", st.Quiet)
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(w, "NAME\tPROJECT\tREF\tPIPELINE\tSTATUS")
+			for _, p := range st.Projects {
+				name := p.Name
+				if name == "" {
+					name = "(unnamed)"
+				}
+				status := p.Status
+				if status == "" {
+					status = "-"
+				}
+				project := p.Path
+				if project == "" {
+					project = strconv.FormatInt(p.ProjectID, 10)
+				}
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", name, project, p.Ref, p.Pipeline, status)
+			}
+			return w.Flush()
+		},
+	}
+	statusCmd.Flags().BoolVar(&ctlJSON, "json", false, "print JSON")
+
+	ctlCmd.AddCommand(
+		simple("pause", "Pause polling", control_unix.CmdPause),
+		simple("resume", "Resume polling", control_unix.CmdResume),
+		simple("toggle", "Toggle pause/resume", control_unix.CmdToggle),
+		simple("reload", "Reload config.yaml", control_unix.CmdReload),
+		pollCmd,
+		statusCmd,
+		openCmd,
+	)
+
+	rootCmd.AddCommand(ctlCmd)
+}
+
+func ctlCall(ctx context.Context, req control_unix.Request) (control_unix.Response, error) {
+	path := ctlSocket
+	if path == "" {
+		// The daemon may run with a token from the environment, so a
+		// missing token must not stop us from finding the socket.
+		cfg, _ := config.Load(cfgPath)
+		path = cfg.Control.Socket
+	}
+	if path == "" {
+		path = control_unix.DefaultPath()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	return control_unix.Call(ctx, path, req)
+}
+
+func controlHandler(log *zap.Logger, sched *application.Scheduler, clients *clientCache) control_unix.Handler {
+	return control_unix.HandlerFunc(func(ctx context.Context, req control_unix.Request) (any, error) {
+		log.Info("control", zap.String("cmd", req.Cmd), zap.String("project", req.Project))
+
+		switch req.Cmd {
+		case control_unix.CmdPause:
+			return nil, sched.Pause()
+		case control_unix.CmdResume:
+			return nil, sched.Resume()
+		case control_unix.CmdToggle:
+			if sched.Status().Paused {
+				return nil, sched.Resume()
+			}
+			return nil, sched.Pause()
+		case control_unix.CmdPoll:
+			return nil, sched.PollNow(req.Project)
+		case control_unix.CmdStatus:
+			return sched.Status(), nil
+		case control_unix.CmdReload:
+			return nil, reloadConfig(ctx, log, sched, clients)
+		default:
+			return nil, fmt.Errorf("unknown command %q", req.Cmd)
+		}
+	})
+}
@@ -20,7 +20,7 @@ var disableCmd = &cobra.Command{
 
 		changed := false
 		for i := range cfg.Poll.Projects {
-			if cfg.Poll.Projects[i].Name == name {
+			if cfg.Poll.Projects[i].DisplayName() == name {
 				if cfg.Poll.Projects[i].Enabled {
 					cfg.Poll.Projects[i].Enabled = false
 					changed = true
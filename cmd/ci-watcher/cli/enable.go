@@ -20,7 +20,7 @@ var enableCmd = &cobra.Command{
 
 		changed := false
 		for i := range cfg.Poll.Projects {
-			if cfg.Poll.Projects[i].Name == name {
+			if cfg.Poll.Projects[i].DisplayName() == name {
 				if !cfg.Poll.Projects[i].Enabled {
 					cfg.Poll.Projects[i].Enabled = true
 					changed = true
@@ -51,12 +51,13 @@ func init() {
 
 		out := make([]string, 0, len(cfg.Poll.Projects))
 		for _, p := range cfg.Poll.Projects {
-			if p.Name == "" {
+			name := p.DisplayName()
+			if name == "" {
 				continue
 			}
 
-			if toComplete == "" || startsWith(p.Name, toComplete) {
-				out = append(out, p.Name)
+			if toComplete == "" || startsWith(name, toComplete) {
+				out = append(out, name)
 			}
 		}
 
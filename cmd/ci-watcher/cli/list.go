@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"text/tabwriter"
 
 	"github.com/davarch/ci-watcher/internal/infrastructure/config"
@@ -44,9 +45,9 @@ var listCmd = &cobra.Command{
 		}
 
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		_, _ = fmt.Fprintln(w, "NAME\tPROJECT_ID\tREF\tENABLED")
+		_, _ = fmt.Fprintln(w, "NAME\tPROJECT\tREF\tENABLED")
 		for _, p := range items {
-			name := p.Name
+			name := p.DisplayName()
 			if name == "" {
 				name = "(unnamed)"
 			}
@@ -54,7 +55,15 @@ var listCmd = &cobra.Command{
 			if p.Enabled {
 				en = "true"
 			}
-			_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", name, p.ProjectID, p.Ref, en)
+			ref := p.Ref
+			if p.Tags {
+				ref = "tags:" + ref
+			}
+			project := p.Path
+			if project == "" {
+				project = strconv.FormatInt(p.ProjectID, 10)
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, project, ref, en)
 		}
 		_ = w.Flush()
 		return nil
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"context"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/application"
+	"github.com/davarch/ci-watcher/internal/domain"
+	"github.com/davarch/ci-watcher/internal/infrastructure/config"
+	"github.com/davarch/ci-watcher/internal/infrastructure/notify_dbus"
+	"github.com/davarch/ci-watcher/internal/infrastructure/notify_libnotify"
+	"github.com/davarch/ci-watcher/internal/infrastructure/notify_webhook"
+	"go.uber.org/zap"
+)
+
+// newNotifier returns the configured notification backend plus any
+// webhooks.
+func newNotifier(log *zap.Logger, cfg config.Config, retry func(ctx context.Context, url string) error) (domain.Notifier, func()) {
+	desktop, closeDesktop := desktopNotifier(log, cfg, retry)
+	if len(cfg.Notify.Webhooks) == 0 {
+		return desktop, closeDesktop
+	}
+
+	targets := make([]notify_webhook.Target, 0, len(cfg.Notify.Webhooks))
+	for _, w := range cfg.Notify.Webhooks {
+		targets = append(targets, notify_webhook.Target{URL: w.URL, Secret: w.Secret, Timeout: w.Timeout, Headers: w.Headers})
+	}
+	hooks := notify_webhook.New(targets, notify_webhook.Options{
+		OnError: func(url string, err error) {
+			log.Warn("webhook delivery failed", zap.String("url", url), zap.Error(err))
+		},
+	})
+
+	return application.Notifiers{desktop, hooks}, func() {
+		closeDesktop()
+		_ = hooks.Close()
+	}
+}
+
+// desktopNotifier returns the configured popup backend, falling back to
+// notify-send when the D-Bus session is unavailable.
+func desktopNotifier(log *zap.Logger, cfg config.Config, retry func(ctx context.Context, url string) error) (domain.Notifier, func()) {
+	if cfg.Notify.Backend == "notify-send" {
+		return notify_libnotify.NewSoft(), func() {}
+	}
+
+	n, err := notify_dbus.New(notify_dbus.Options{
+		Retry:        retry,
+		RetryTimeout: retryTimeout(cfg),
+		OnError: func(action, url string, err error) {
+			log.Warn("notification action failed", zap.String("action", action), zap.String("url", url), zap.Error(err))
+		},
+	})
+	if err != nil {
+		log.Warn("dbus notifications unavailable, using notify-send", zap.Error(err))
+		return notify_libnotify.NewSoft(), func() {}
+	}
+	return n, func() { _ = n.Close() }
+}
+
+// retryTimeout is the longest instance timeout, since a retry is a single
+// request to whichever instance owns the pipeline.
+func retryTimeout(cfg config.Config) time.Duration {
+	var d time.Duration
+	for _, in := range cfg.GitLabs() {
+		d = max(d, in.Timeout)
+	}
+	return d
+}
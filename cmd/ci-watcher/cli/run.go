@@ -2,8 +2,10 @@ package cli
 
 import (
 	"context"
+	"fmt"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -11,9 +13,9 @@ import (
 	"github.com/davarch/ci-watcher/internal/domain"
 	"github.com/davarch/ci-watcher/internal/infrastructure/cache_fs"
 	"github.com/davarch/ci-watcher/internal/infrastructure/config"
+	"github.com/davarch/ci-watcher/internal/infrastructure/control_unix"
 	"github.com/davarch/ci-watcher/internal/infrastructure/gitlab_http"
 	"github.com/davarch/ci-watcher/internal/infrastructure/logging"
-	"github.com/davarch/ci-watcher/internal/infrastructure/notify_libnotify"
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -31,35 +33,50 @@ var runCmd = &cobra.Command{
 			log.Fatal("config", zap.Error(err))
 		}
 
-		gl := gitlab_http.New(cfg.GitLab.BaseURL, cfg.GitLab.Token, cfg.GitLab.Timeout)
-		note := notify_libnotify.NewSoft()
+		var uc *application.PollUseCase
+		note, closeNote := newNotifier(log, cfg, func(ctx context.Context, url string) error {
+			return uc.Retry(ctx, url)
+		})
+		defer closeNote()
 		cache := cache_fs.New(cfg.Cache.Path)
 
-		uc := application.NewPollUseCase(gl, note, cache)
-
-		var refs []domain.ProjectRef
-		for _, p := range cfg.Poll.Projects {
-			if p.Enabled {
-				refs = append(refs, domain.ProjectRef{ProjectID: p.ProjectID, Ref: p.Ref})
-			}
+		clients := newClientCache()
+		st, err := schedulerSettings(cmd.Context(), cfg, clients)
+		if err != nil {
+			log.Fatal("gitlab", zap.Error(err))
 		}
-		if len(refs) == 0 {
+		if len(st.Refs) == 0 && len(st.Sources) == 0 {
 			log.Fatal("no enabled projects")
 		}
 
-		sched := application.NewScheduler(log, uc, refs, cfg.Poll.Interval, cfg.Poll.PauseFile)
-		watchAndReload(cfgPath, cfg.Poll.Interval, log, sched)
+		uc = application.NewPollUseCase(st.Gitlab, note, cache)
+		sched := application.NewScheduler(log, uc, st)
 
 		ctx, cancel := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
 		defer cancel()
 
+		watchAndReload(ctx, cfgPath, log, sched, clients)
+
+		socket := cfg.Control.Socket
+		if socket == "" {
+			socket = control_unix.DefaultPath()
+		}
+		go func() {
+			srv := control_unix.NewServer(socket, controlHandler(log, sched, clients))
+			if err := srv.Serve(ctx); err != nil {
+				log.Warn("control socket failed", zap.String("socket", socket), zap.Error(err))
+			}
+		}()
+
 		log.Info("start",
 			zap.String("version", version),
-			zap.Int("projects", len(refs)),
+			zap.Int("projects", len(st.Refs)),
 			zap.Duration("every", cfg.Poll.Interval),
 			zap.String("cache", cfg.Cache.Path),
 			zap.String("gitlab", cfg.GitLab.BaseURL),
+			zap.Int("instances", len(cfg.Instances)),
 			zap.String("pause_file", cfg.Poll.PauseFile),
+			zap.String("socket", socket),
 		)
 		sched.Run(ctx)
 	},
@@ -69,7 +86,194 @@ func init() {
 	rootCmd.AddCommand(runCmd)
 }
 
-func watchAndReload(cfgPath string, _ time.Duration, log *zap.Logger, sched *application.Scheduler) {
+func projectRef(cfg config.Config, p config.Project) domain.ProjectRef {
+	return domain.ProjectRef{
+		Instance:  p.Instance,
+		ProjectID: p.ProjectID,
+		Path:      p.Path,
+		Ref:       p.Ref,
+		Name:      p.DisplayName(),
+		Users:     domain.NewUserFilter(cfg.Usernames(p)),
+		Tag:       p.Tags,
+	}
+}
+
+// isBranchGlob reports whether p watches every branch matching its ref.
+func isBranchGlob(p config.Project) bool {
+	return !p.Tags && domain.IsRefPattern(p.Ref)
+}
+
+// enabledRefs returns the refs watched as configured; glob refs are
+// resolved at runtime by branchSources instead.
+func enabledRefs(cfg config.Config) []domain.ProjectRef {
+	var refs []domain.ProjectRef
+	for _, p := range cfg.Poll.Projects {
+		if p.Enabled && !isBranchGlob(p) {
+			refs = append(refs, projectRef(cfg, p))
+		}
+	}
+	return refs
+}
+
+// branchSources returns a source per enabled project whose ref is a glob,
+// expanding it to the matching branches.
+func branchSources(cfg config.Config, clients map[string]*gitlab_http.Client) []domain.RefSource {
+	var out []domain.RefSource
+	for _, p := range cfg.Poll.Projects {
+		if !p.Enabled || !isBranchGlob(p) {
+			continue
+		}
+		pattern, gl := projectRef(cfg, p), clients[p.Instance]
+		out = append(out, domain.RefSourceFunc(func(ctx context.Context) ([]domain.ProjectRef, error) {
+			branches, err := gl.Branches(ctx, pattern)
+			if err != nil {
+				return nil, err
+			}
+			refs := make([]domain.ProjectRef, 0, len(branches))
+			for _, b := range branches {
+				pr := pattern
+				pr.Ref = b
+				refs = append(refs, pr)
+			}
+			return refs, nil
+		}))
+	}
+	return out
+}
+
+// groupSources returns a source per configured group listing its projects'
+// default branches. Projects also listed under poll.projects are left to
+// that entry, which may override interval or filters.
+func groupSources(cfg config.Config, clients map[string]*gitlab_http.Client) []domain.RefSource {
+	users := domain.NewUserFilter(cfg.Usernames(config.Project{}))
+	listed := make(map[string]bool)
+	for _, p := range cfg.Poll.Projects {
+		listed[p.Instance+"|"+strconv.FormatInt(p.ProjectID, 10)] = true
+		listed[p.Instance+"|"+p.Path] = true
+	}
+
+	var out []domain.RefSource
+	for _, g := range cfg.Poll.Groups {
+		gl := clients[g.Instance]
+		out = append(out, domain.RefSourceFunc(func(ctx context.Context) ([]domain.ProjectRef, error) {
+			projects, err := gl.GroupProjects(ctx, g.Group, g.Archived)
+			if err != nil {
+				return nil, err
+			}
+			refs := make([]domain.ProjectRef, 0, len(projects))
+			for _, pr := range projects {
+				if g.Matches(pr.Path) && !listed[g.Instance+"|"+pr.Path] && !listed[g.Instance+"|"+strconv.FormatInt(pr.ProjectID, 10)] {
+					pr.Instance, pr.Users = g.Instance, users
+					refs = append(refs, pr)
+				}
+			}
+			return refs, nil
+		}))
+	}
+	return out
+}
+
+func schedulerSettings(ctx context.Context, cfg config.Config, cache *clientCache) (application.Settings, error) {
+	intervals := make(map[domain.ProjectRef]time.Duration)
+	projectRules := make(map[domain.ProjectRef]application.Rules)
+	for _, p := range cfg.Poll.Projects {
+		if p.Enabled && p.Interval > 0 {
+			intervals[projectRef(cfg, p)] = p.Interval
+		}
+		if p.Enabled && p.Notify != nil {
+			projectRules[projectRef(cfg, p)] = application.NewRules(cfg.NotifyEvents(p))
+		}
+	}
+
+	quiet, err := cfg.Notify.QuietHours.Parse()
+	if err != nil {
+		return application.Settings{}, err
+	}
+
+	styles := application.DefaultNotificationStyles()
+	for name, style := range cfg.Notify.Styles {
+		st, _ := domain.ParseStatus(name)
+		styles[st] = style.Apply(styles[st])
+	}
+
+	clients, err := cache.update(ctx, cfg.GitLabs())
+	if err != nil {
+		return application.Settings{}, err
+	}
+	router := make(application.GitlabRouter, len(clients))
+	for name, gl := range clients {
+		router[name] = gl
+	}
+
+	sources := append(branchSources(cfg, clients), groupSources(cfg, clients)...)
+	if mr := cfg.Poll.MergeRequests; mr.Enabled {
+		scopes := mr.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"created_by_me", "assigned_to_me"}
+		}
+		// One source per instance, so an unreachable one keeps its last
+		// known merge requests without affecting the others.
+		for _, in := range cfg.GitLabs() {
+			name, gl := in.Name, clients[in.Name]
+			sources = append(sources, domain.RefSourceFunc(func(ctx context.Context) ([]domain.ProjectRef, error) {
+				refs, err := gl.OpenMergeRequests(ctx, scopes)
+				for i := range refs {
+					refs[i].Instance = name
+				}
+				return refs, err
+			}))
+		}
+	}
+
+	return application.Settings{
+		Refs:        enabledRefs(cfg),
+		Every:       cfg.Poll.Interval,
+		PauseFile:   cfg.Poll.PauseFile,
+		Intervals:   intervals,
+		Concurrency: cfg.Poll.Concurrency,
+		Adaptive: application.Adaptive{
+			Enabled: cfg.Poll.Adaptive.Enabled,
+			Active:  cfg.Poll.Adaptive.Active,
+			Idle:    cfg.Poll.Adaptive.Idle,
+		},
+		Rules:         application.NewRules(cfg.NotifyEvents(config.Project{})),
+		ProjectRules:  projectRules,
+		SilentStart:   cfg.Notify.SilentStart,
+		Quiet:         quiet,
+		Styles:        styles,
+		Sources:       sources,
+		DiscoverEvery: cfg.Poll.DiscoverInterval,
+		Gitlab:        router,
+	}, nil
+}
+
+func reloadConfig(ctx context.Context, log *zap.Logger, sched *application.Scheduler, clients *clientCache) error {
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return err
+	}
+	st, err := schedulerSettings(ctx, cfg, clients)
+	if err != nil {
+		return err
+	}
+	if len(st.Refs) == 0 && len(st.Sources) == 0 {
+		log.Warn("config reload: no enabled projects")
+	}
+	sched.Reload(st)
+	return nil
+}
+
+func instanceErr(in config.GitLab, err error) error {
+	name := "gitlab"
+	if in.Name != "" {
+		name = "instance " + strconv.Quote(in.Name)
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
+
+// watchAndReload reloads the scheduler whenever cfgPath changes on disk,
+// debounced to coalesce editors' write bursts. It stops when ctx is done.
+func watchAndReload(ctx context.Context, cfgPath string, log *zap.Logger, sched *application.Scheduler, clients *clientCache) {
 	if cfgPath == "" {
 		return
 	}
@@ -83,53 +287,23 @@ func watchAndReload(cfgPath string, _ time.Duration, log *zap.Logger, sched *app
 		return
 	}
 
+	if err := w.Add(dir); err != nil {
+		log.Warn("fsnotify add dir failed", zap.String("dir", dir), zap.Error(err))
+		_ = w.Close()
+		return
+	}
+
 	go func() {
 		defer func() { _ = w.Close() }()
 
-		var (
-			timer *time.Timer
-			_     bool
-			fire  = func() {
-				_ = false
-				cfg, err := config.Load(cfgPath)
-				if err != nil {
-					log.Warn("config reload failed", zap.Error(err))
-					return
-				}
-				var refs []domain.ProjectRef
-				for _, p := range cfg.Poll.Projects {
-					if p.Enabled {
-						refs = append(refs, domain.ProjectRef{ProjectID: p.ProjectID, Ref: p.Ref})
-					}
-				}
-				if len(refs) == 0 {
-					log.Warn("config reload: no enabled projects")
-				}
-				sched.UpdateRefs(refs)
-
-				go sched.Run(context.WithValue(context.Background(), struct{}{}, nil))
-			}
-		)
-
-		startTimer := func() {
-			if timer == nil {
-				timer = time.AfterFunc(300*time.Millisecond, fire)
-			} else {
-				if !timer.Stop() {
-					<-timer.C
-				}
-				timer.Reset(300 * time.Millisecond)
-			}
-			_ = true
-		}
-
-		if err := w.Add(dir); err != nil {
-			log.Warn("fsnotify add dir failed", zap.String("dir", dir), zap.Error(err))
-			return
-		}
+		debounce := time.NewTimer(time.Hour)
+		debounce.Stop()
 
 		for {
 			select {
+			case <-ctx.Done():
+				debounce.Stop()
+				return
 			case ev, ok := <-w.Events:
 				if !ok {
 					return
@@ -140,13 +314,17 @@ func watchAndReload(cfgPath string, _ time.Duration, log *zap.Logger, sched *app
 				}
 
 				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
-					startTimer()
+					debounce.Reset(300 * time.Millisecond)
 				}
 			case err, ok := <-w.Errors:
 				if !ok {
 					return
 				}
 				log.Warn("fsnotify error", zap.Error(err))
+			case <-debounce.C:
+				if err := reloadConfig(ctx, log, sched, clients); err != nil {
+					log.Warn("config reload failed", zap.Error(err))
+				}
 			}
 		}
 	}()
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/davarch/ci-watcher/internal/infrastructure/config"
+	"github.com/davarch/ci-watcher/internal/infrastructure/keyring_secrettool"
+	"github.com/spf13/cobra"
+)
+
+var tokenInstance string
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage GitLab tokens in the system keyring",
+}
+
+var tokenSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Store a GitLab token in the keyring (read from stdin)",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		token, err := readToken()
+		if err != nil {
+			return err
+		}
+
+		account := config.GitLab{Name: tokenInstance}.KeyringAccount()
+		if err := keyring_secrettool.Store(cmd.Context(), account, token); err != nil {
+			return err
+		}
+
+		section := "gitlab"
+		if tokenInstance != "" {
+			section = fmt.Sprintf("instances[name=%s]", tokenInstance)
+		}
+		fmt.Printf("stored token for %s; set token_keyring: true under %s and remove its token\n", account, section)
+		return nil
+	},
+}
+
+func init() {
+	tokenSetCmd.Flags().StringVar(&tokenInstance, "instance", "", "named GitLab instance (default: the gitlab section)")
+	tokenCmd.AddCommand(tokenSetCmd)
+	rootCmd.AddCommand(tokenCmd)
+}
+
+// readToken reads one line from stdin, prompting without echo when stdin
+// is a terminal.
+func readToken() (string, error) {
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		_, _ = fmt.Fprint(os.Stderr, "GitLab token: ")
+		if stty("-echo") == nil {
+			defer func() {
+				_ = stty("echo")
+				_, _ = fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("read token: %w", err)
+	}
+	token := strings.TrimSpace(line)
+	if token == "" {
+		return "", errors.New("empty token")
+	}
+	return token, nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,168 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/infrastructure/cache_fs"
+	"github.com/davarch/ci-watcher/internal/infrastructure/config"
+	"github.com/davarch/ci-watcher/internal/infrastructure/waybar"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+)
+
+var waybarOnce bool
+
+var waybarCmd = &cobra.Command{
+	Use:   "waybar",
+	Short: "Print Waybar JSON for the status cache (one line per change)",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Only the cache and pause file are read, so Waybar's environment
+		// need not have the daemon's token.
+		cfg, err := config.Load(cfgPath)
+		if err != nil && !errors.Is(err, config.ErrNoToken) {
+			return err
+		}
+
+		r, err := waybar.New(waybar.Options{
+			Format:        cfg.Waybar.Format,
+			TooltipFormat: cfg.Waybar.TooltipFormat,
+			PausedFormat:  cfg.Waybar.PausedFormat,
+			EmptyFormat:   cfg.Waybar.EmptyFormat,
+			Classes:       cfg.Waybar.Classes,
+		})
+		if err != nil {
+			return err
+		}
+
+		var last []byte
+		emit := func() error {
+			f, _ := cache_fs.Read(cfg.Cache.Path)
+			line, err := r.Line(f, isPaused(cfg.Poll.PauseFile))
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(line, last) {
+				return nil
+			}
+			last = line
+			_, err = fmt.Fprintf(os.Stdout, "%s\n", line)
+			return err
+		}
+
+		if err := emit(); err != nil || waybarOnce {
+			return err
+		}
+
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		defer func() { _ = w.Close() }()
+
+		paths := []string{cfg.Cache.Path}
+		if cfg.Poll.PauseFile != "" {
+			paths = append(paths, cfg.Poll.PauseFile)
+		}
+		watched := map[string]struct{}{}
+		for _, p := range paths {
+			watched[filepath.Base(p)] = struct{}{}
+		}
+
+		// A missing directory is not created here; its nearest existing
+		// parent is watched instead until it appears.
+		dirs := map[string]struct{}{}
+		watch := func() error {
+			for _, p := range paths {
+				d := existingDir(filepath.Dir(p))
+				if _, ok := dirs[d]; ok {
+					continue
+				}
+				if err := w.Add(d); err != nil {
+					return err
+				}
+				dirs[d] = struct{}{}
+			}
+			return nil
+		}
+		if err := watch(); err != nil {
+			return err
+		}
+
+		debounce := time.NewTimer(time.Hour)
+		debounce.Stop()
+
+		for {
+			select {
+			case <-cmd.Context().Done():
+				return nil
+			case ev, ok := <-w.Events:
+				if !ok {
+					return nil
+				}
+				if ev.Has(fsnotify.Create) && isAncestor(ev.Name, paths) {
+					if err := watch(); err != nil {
+						return err
+					}
+					debounce.Reset(100 * time.Millisecond)
+				}
+				if _, ok := watched[filepath.Base(ev.Name)]; ok {
+					debounce.Reset(100 * time.Millisecond)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return nil
+				}
+				return err
+			case <-debounce.C:
+				if err := emit(); err != nil {
+					return err
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	waybarCmd.Flags().BoolVar(&waybarOnce, "once", false, "print a single line and exit")
+
+	rootCmd.AddCommand(waybarCmd)
+}
+
+func isPaused(pauseFile string) bool {
+	if pauseFile == "" {
+		return false
+	}
+	_, err := os.Stat(pauseFile)
+	return err == nil
+}
+
+// existingDir returns d or its nearest parent that exists.
+func existingDir(d string) string {
+	for {
+		if fi, err := os.Stat(d); err == nil && fi.IsDir() {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return d
+		}
+		d = parent
+	}
+}
+
+// isAncestor reports whether dir is a parent directory of any of paths.
+func isAncestor(dir string, paths []string) bool {
+	for _, p := range paths {
+		if strings.HasPrefix(filepath.Dir(p)+string(filepath.Separator), filepath.Clean(dir)+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+)
+
+var ErrUnknownInstance = errors.New("unknown gitlab instance")
+
+// GitlabRouter sends each ref to the client of its GitLab instance; the
+// default instance is keyed by "".
+type GitlabRouter map[string]domain.GitlabClient
+
+func (r GitlabRouter) LatestPipeline(ctx context.Context, pr domain.ProjectRef) (domain.Pipeline, error) {
+	gl, ok := r[pr.Instance]
+	if !ok {
+		return domain.Pipeline{}, fmt.Errorf("%w %q", ErrUnknownInstance, pr.Instance)
+	}
+	return gl.LatestPipeline(ctx, pr)
+}
+
+// RetryPipeline asks every instance's client to retry webURL; only the one
+// hosting it does.
+func (r GitlabRouter) RetryPipeline(ctx context.Context, webURL string) error {
+	for _, gl := range r {
+		rt, ok := gl.(domain.PipelineRetrier)
+		if !ok {
+			continue
+		}
+		if err := rt.RetryPipeline(ctx, webURL); !errors.Is(err, domain.ErrForeignPipeline) {
+			return err
+		}
+	}
+	return domain.ErrForeignPipeline
+}
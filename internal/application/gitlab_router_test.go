@@ -0,0 +1,25 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+)
+
+func TestGitlabRouter_RoutesByInstance(t *testing.T) {
+	com := &domain.MockGitLab{Pipeline: domain.Pipeline{ID: 1}}
+	corp := &domain.MockGitLab{Pipeline: domain.Pipeline{ID: 2}}
+	r := GitlabRouter{"": com, "corp": corp}
+
+	if p, _ := r.LatestPipeline(context.Background(), domain.ProjectRef{ProjectID: 7}); p.ID != 1 {
+		t.Errorf("expected default instance, got %+v", p)
+	}
+	if p, _ := r.LatestPipeline(context.Background(), domain.ProjectRef{ProjectID: 7, Instance: "corp"}); p.ID != 2 {
+		t.Errorf("expected corp instance, got %+v", p)
+	}
+	if _, err := r.LatestPipeline(context.Background(), domain.ProjectRef{Instance: "nope"}); !errors.Is(err, ErrUnknownInstance) {
+		t.Errorf("expected ErrUnknownInstance, got %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package application
+
+import (
+	"context"
+	"errors"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+)
+
+// Notifiers sends every notification to each of its notifiers.
+type Notifiers []domain.Notifier
+
+func (ns Notifiers) Notify(ctx context.Context, n domain.Notification) error {
+	var errs []error
+	for _, note := range ns {
+		if err := note.Notify(ctx, n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -2,7 +2,11 @@ package application
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/davarch/ci-watcher/internal/domain"
@@ -13,46 +17,346 @@ type PollUseCase struct {
 	note  domain.Notifier
 	cache domain.StatusCache
 
-	last map[domain.ProjectRef]struct {
-		id     int64
-		status domain.PipelineStatus
+	mu   sync.Mutex
+	last map[domain.ProjectRef]domain.Pipeline
+	// watching reports whether a ref is still watched; results for other
+	// refs come from polls that raced with their removal and are dropped.
+	watching func(domain.ProjectRef) bool
+	// settled is the last success or failure of each ref.
+	settled      map[domain.ProjectRef]domain.PipelineStatus
+	rules        Rules
+	projectRules map[domain.ProjectRef]Rules
+	silentStart  bool
+	// starting lasts until the scheduler's first round of polls is done.
+	starting bool
+	styles       map[domain.PipelineStatus]domain.NotificationStyle
+
+	// While quiet, notifications are dropped or, with digest, the latest
+	// of each ref is held in order until SetQuiet(false).
+	quiet     bool
+	digest    bool
+	held      map[domain.ProjectRef]domain.Notification
+	heldOrder []domain.ProjectRef
+}
+
+// DefaultNotificationStyles makes failures critical and sticky, lets
+// successes expire after 5s and keeps running pipelines silent.
+func DefaultNotificationStyles() map[domain.PipelineStatus]domain.NotificationStyle {
+	return map[domain.PipelineStatus]domain.NotificationStyle{
+		domain.StatusFailed:    {Severity: domain.SeverityCritical, Sticky: true, Icon: "dialog-error"},
+		domain.StatusSuccess:   {Severity: domain.SeverityNormal, Expire: 5 * time.Second, Icon: "emblem-default"},
+		domain.StatusRunning:   {Severity: domain.SeverityLow, Silent: true, Icon: "media-playback-start"},
+		domain.StatusCancelled: {Severity: domain.SeverityNormal, Icon: "process-stop"},
+		domain.StatusManual:    {Severity: domain.SeverityNormal, Icon: "dialog-question"},
 	}
 }
 
 func NewPollUseCase(gl domain.GitlabClient, note domain.Notifier, cache domain.StatusCache) *PollUseCase {
 	return &PollUseCase{
 		gl: gl, note: note, cache: cache,
-		last: make(map[domain.ProjectRef]struct {
-			id     int64
-			status domain.PipelineStatus
-		}),
+		last:    make(map[domain.ProjectRef]domain.Pipeline),
+		settled: make(map[domain.ProjectRef]domain.PipelineStatus),
+		styles:   DefaultNotificationStyles(),
+		held:     make(map[domain.ProjectRef]domain.Notification),
+		starting: true,
+	}
+}
+
+// SetRules sets which transitions notify. perProject overrides rules for
+// its keys and, for glob keys, the branches they expand to. The cache is
+// updated regardless.
+func (uc *PollUseCase) SetRules(rules Rules, perProject map[domain.ProjectRef]Rules) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.rules = rules
+	uc.projectRules = perProject
+}
+
+// SetSilentStart only records the first pipeline seen for each ref until
+// EndStartup, so a restart does not repeat every current status.
+func (uc *PollUseCase) SetSilentStart(silent bool) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.silentStart = silent
+}
+
+// EndStartup makes refs seen from now on, e.g. a new merge request,
+// notify even with silent start.
+func (uc *PollUseCase) EndStartup() {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.starting = false
+}
+
+// SetStyles sets how notifications of each status are presented. Statuses
+// without a style get a normal one; nil restores the defaults.
+func (uc *PollUseCase) SetStyles(styles map[domain.PipelineStatus]domain.NotificationStyle) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if styles == nil {
+		styles = DefaultNotificationStyles()
+	}
+	uc.styles = styles
+}
+
+// SetQuiet starts or ends quiet hours. While quiet the cache keeps
+// updating but nothing is notified; with digest, ending quiet hours sends
+// one notification with the latest of every held back change.
+func (uc *PollUseCase) SetQuiet(ctx context.Context, quiet, digest bool) {
+	uc.mu.Lock()
+	was := uc.quiet
+	uc.quiet, uc.digest = quiet, digest
+	if quiet || !was {
+		uc.mu.Unlock()
+		return
+	}
+	held := make([]domain.Notification, 0, len(uc.heldOrder))
+	for _, pr := range uc.heldOrder {
+		held = append(held, uc.held[pr])
+	}
+	clear(uc.held)
+	uc.heldOrder = nil
+	var style domain.NotificationStyle
+	if len(held) > 0 {
+		style = uc.styles[worstOf(held)]
+	}
+	uc.mu.Unlock()
+
+	if len(held) > 0 && digest {
+		_ = uc.note.Notify(ctx, digestOf(held, style))
 	}
 }
 
+// Quiet reports whether quiet hours are on.
+func (uc *PollUseCase) Quiet() bool {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.quiet
+}
+
+// SetWatching sets which refs' poll results are kept; nil keeps all. It
+// is called with the use case locked and must not call back into it.
+func (uc *PollUseCase) SetWatching(watching func(domain.ProjectRef) bool) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.watching = watching
+}
+
+// SetGitlab swaps the client used by subsequent polls.
+func (uc *PollUseCase) SetGitlab(gl domain.GitlabClient) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.gl = gl
+}
+
 func (uc *PollUseCase) PollOnce(ctx context.Context, pr domain.ProjectRef) error {
-	p, err := uc.gl.LatestPipeline(ctx, pr)
+	uc.mu.Lock()
+	gl := uc.gl
+	uc.mu.Unlock()
+
+	p, err := gl.LatestPipeline(ctx, pr)
 	if err != nil {
 		return err
 	}
 
+	uc.mu.Lock()
+	if uc.watching != nil && !uc.watching(pr) {
+		uc.mu.Unlock()
+		return nil
+	}
 	prev, ok := uc.last[pr]
-	changed := !ok || prev.id != p.ID || prev.status != p.Status
+	changed := !ok || prev.ID != p.ID || prev.Status != p.Status
+	var ev domain.Event
+	if changed {
+		uc.last[pr] = p
+		ev = transition(uc.settled[pr], p)
+		if p.Status == domain.StatusSuccess || p.Status == domain.StatusFailed {
+			uc.settled[pr] = p.Status
+		}
+	}
+	notify := changed && uc.rulesFor(pr).Allows(ev) && (ok || !uc.silentStart || !uc.starting)
+	style, ok := uc.styles[p.Status]
+	if !ok {
+		style = domain.NotificationStyle{Severity: domain.SeverityNormal, Icon: "dialog-information"}
+	}
+	var note domain.Notification
+	if notify {
+		note = notificationFor(pr, p, ev, style)
+		if uc.quiet {
+			if uc.digest {
+				if _, seen := uc.held[pr]; !seen {
+					uc.heldOrder = append(uc.heldOrder, pr)
+				}
+				uc.held[pr] = note
+			}
+			notify = false
+		}
+	}
+	uc.mu.Unlock()
+
 	if changed {
 		_ = uc.cache.Write(ctx, domain.Snapshot{
 			Project: pr, Pipeline: p, Retrieved: time.Now().Unix(),
 		})
+	}
+	if notify {
+		_ = uc.note.Notify(ctx, note)
+	}
+
+	return nil
+}
 
-		title := titleFor(p.Status)
-		body := "Pipeline #" + strconv.FormatInt(p.ID, 10) + " (" + p.Ref + ")"
-		_ = uc.note.Notify(ctx, title, body, p.WebURL)
+// Retry retries the pipeline at webURL, e.g. from a notification action.
+func (uc *PollUseCase) Retry(ctx context.Context, webURL string) error {
+	uc.mu.Lock()
+	gl := uc.gl
+	uc.mu.Unlock()
 
-		uc.last[pr] = struct {
-			id     int64
-			status domain.PipelineStatus
-		}{p.ID, p.Status}
+	rt, ok := gl.(domain.PipelineRetrier)
+	if !ok {
+		return errors.New("gitlab client cannot retry pipelines")
 	}
+	return rt.RetryPipeline(ctx, webURL)
+}
 
-	return nil
+// Last returns the last pipeline seen for pr.
+func (uc *PollUseCase) Last(pr domain.ProjectRef) (domain.Pipeline, bool) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	p, ok := uc.last[pr]
+	return p, ok
+}
+
+// Retain drops cached state of projects that are no longer watched.
+func (uc *PollUseCase) Retain(ctx context.Context, refs []domain.ProjectRef) error {
+	keep := make(map[domain.ProjectRef]struct{}, len(refs))
+	for _, pr := range refs {
+		keep[pr] = struct{}{}
+	}
+
+	uc.mu.Lock()
+	for pr := range uc.last {
+		if _, ok := keep[pr]; !ok {
+			delete(uc.last, pr)
+			delete(uc.settled, pr)
+		}
+	}
+	uc.heldOrder = slices.DeleteFunc(uc.heldOrder, func(pr domain.ProjectRef) bool {
+		if _, ok := keep[pr]; !ok {
+			delete(uc.held, pr)
+			return true
+		}
+		return false
+	})
+	uc.mu.Unlock()
+
+	return uc.cache.Retain(ctx, refs)
+}
+
+// rulesFor must be called with uc.mu held.
+func (uc *PollUseCase) rulesFor(pr domain.ProjectRef) Rules {
+	if r, ok := uc.projectRules[pr]; ok {
+		return r
+	}
+	for k, r := range uc.projectRules {
+		if k.Covers(pr) {
+			return r
+		}
+	}
+	return uc.rules
+}
+
+func notificationFor(pr domain.ProjectRef, p domain.Pipeline, ev domain.Event, style domain.NotificationStyle) domain.Notification {
+	title := titleFor(p.Status)
+	switch ev {
+	case domain.EventRecovered:
+		title = "✅ CI: recovered"
+	case domain.EventStillFailing:
+		title = "❌ CI: still failing"
+	}
+	if pr.Tag && p.Ref != "" {
+		title += " · " + p.Ref
+	}
+	return domain.Notification{
+		Title:             title,
+		Body:              bodyFor(pr, p),
+		URL:               p.WebURL,
+		Project:           pr.Label(),
+		Status:            p.Status,
+		Event:             ev,
+		Category:          "x-ci-watcher." + string(p.Status),
+		Retryable:         p.Status == domain.StatusFailed || p.Status == domain.StatusCancelled,
+		Pipeline:          p,
+		NotificationStyle: style,
+	}
+}
+
+// digestOf folds notifications held back during quiet hours into one.
+func digestOf(held []domain.Notification, style domain.NotificationStyle) domain.Notification {
+	d := domain.Notification{
+		Title:             "🌙 CI: " + strconv.Itoa(len(held)) + " updates during quiet hours",
+		Status:            worstOf(held),
+		Event:             domain.EventDigest,
+		Category:          "x-ci-watcher.digest",
+		NotificationStyle: style,
+	}
+	if len(held) == 1 {
+		d.Title = "🌙 CI: 1 update during quiet hours"
+		d.URL = held[0].URL
+	}
+
+	lines := make([]string, 0, len(held))
+	for _, n := range held {
+		line := n.Pipeline.Ref + ": " + strings.ReplaceAll(string(n.Event), "_", " ")
+		if n.Project != "" {
+			line = n.Project + " · " + line
+		}
+		lines = append(lines, line)
+	}
+	d.Body = strings.Join(lines, "\n")
+	return d
+}
+
+func worstOf(held []domain.Notification) domain.PipelineStatus {
+	statuses := make([]domain.PipelineStatus, 0, len(held))
+	for _, n := range held {
+		statuses = append(statuses, n.Status)
+	}
+	return domain.Worst(statuses...)
+}
+
+func bodyFor(pr domain.ProjectRef, p domain.Pipeline) string {
+	var b strings.Builder
+	if l := pr.Label(); l != "" {
+		b.WriteString(l + " · ")
+	}
+	b.WriteString("Pipeline #" + strconv.FormatInt(p.ID, 10) + " (" + p.Ref + ")")
+	if p.Duration > 0 {
+		b.WriteString(" · " + p.Duration.Round(time.Second).String())
+	}
+	if p.SHA != "" || p.CommitTitle != "" {
+		b.WriteString("\n" + shortSHA(p.SHA))
+		if p.CommitTitle != "" {
+			b.WriteString(" " + p.CommitTitle)
+		}
+	}
+	if p.Author != "" {
+		b.WriteString("\nby " + p.Author)
+	}
+	for _, j := range p.FailedJobs {
+		b.WriteString("\n✗ " + j.Stage + ": " + j.Name)
+		if j.FailureReason != "" {
+			b.WriteString(" (" + j.FailureReason + ")")
+		}
+	}
+	return b.String()
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
 }
 
 func titleFor(s domain.PipelineStatus) string {
@@ -65,6 +369,20 @@ func titleFor(s domain.PipelineStatus) string {
 		return "▶️ CI: running"
 	case domain.StatusCancelled:
 		return "⛔ CI: canceled"
+	case domain.StatusPending:
+		return "⏳ CI: pending"
+	case domain.StatusCreated:
+		return "🆕 CI: created"
+	case domain.StatusWaitingForResource:
+		return "⏳ CI: waiting for resource"
+	case domain.StatusPreparing:
+		return "⚙️ CI: preparing"
+	case domain.StatusManual:
+		return "✋ CI: manual action required"
+	case domain.StatusScheduled:
+		return "🕒 CI: scheduled"
+	case domain.StatusSkipped:
+		return "⏭️ CI: skipped"
 	default:
 		return "ℹ️ CI: " + string(s)
 	}
@@ -2,7 +2,9 @@ package application
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/davarch/ci-watcher/internal/domain"
 )
@@ -40,3 +42,211 @@ func TestPollOnce_SamePipelineDoesNothing(t *testing.T) {
 		t.Errorf("expected 1 notification total, got %d", len(note.Messages))
 	}
 }
+
+func TestPollOnce_EventsFilterStatuses(t *testing.T) {
+	gl := &domain.MockGitLab{Pipeline: domain.Pipeline{ID: 1, Ref: "main", Status: domain.StatusPending}}
+	note := &domain.MockNotifier{}
+	cache := &domain.MockCache{}
+	uc := NewPollUseCase(gl, note, cache)
+	uc.SetRules(NewRules([]domain.Event{domain.EventFailed}), nil)
+	pr := domain.ProjectRef{ProjectID: 42, Ref: "main"}
+
+	_ = uc.PollOnce(context.Background(), pr)
+	gl.Pipeline.Status = domain.StatusFailed
+	_ = uc.PollOnce(context.Background(), pr)
+
+	if len(note.Messages) != 1 || !strings.HasPrefix(note.Messages[0], "❌ CI: failed|") {
+		t.Errorf("expected only the failed notification, got %v", note.Messages)
+	}
+	if len(cache.Snapshots) != 2 {
+		t.Errorf("expected cache to track both statuses, got %d", len(cache.Snapshots))
+	}
+}
+
+func TestPollOnce_FailedJobsInBody(t *testing.T) {
+	gl := &domain.MockGitLab{Pipeline: domain.Pipeline{
+		ID: 7, Ref: "main", Status: domain.StatusFailed,
+		FailedJobs: []domain.Job{{Name: "unit", Stage: "test", FailureReason: "script_failure"}},
+	}}
+	note := &domain.MockNotifier{}
+	uc := NewPollUseCase(gl, note, &domain.MockCache{})
+
+	_ = uc.PollOnce(context.Background(), domain.ProjectRef{ProjectID: 42, Ref: "main"})
+
+	want := "❌ CI: failed|Pipeline #7 (main)\n✗ test: unit (script_failure)|"
+	if len(note.Messages) != 1 || note.Messages[0] != want {
+		t.Errorf("unexpected notification %q", note.Messages)
+	}
+}
+
+func TestPollOnce_CommitAndAuthorInBody(t *testing.T) {
+	gl := &domain.MockGitLab{Pipeline: domain.Pipeline{
+		ID: 8, Ref: "main", Status: domain.StatusSuccess,
+		SHA: "0123456789abcdef", CommitTitle: "Fix flaky test", Author: "Jane Doe",
+		Duration: 192*time.Second + 400*time.Millisecond,
+	}}
+	note := &domain.MockNotifier{}
+	uc := NewPollUseCase(gl, note, &domain.MockCache{})
+
+	_ = uc.PollOnce(context.Background(), domain.ProjectRef{ProjectID: 42, Ref: "main"})
+
+	want := "✅ CI: success|Pipeline #8 (main) · 3m12s\n01234567 Fix flaky test\nby Jane Doe|"
+	if len(note.Messages) != 1 || note.Messages[0] != want {
+		t.Errorf("unexpected notification %q", note.Messages)
+	}
+}
+
+func TestPollOnce_TagVersionInTitle(t *testing.T) {
+	gl := &domain.MockGitLab{Pipeline: domain.Pipeline{ID: 9, Ref: "v1.4.0", Status: domain.StatusSuccess}}
+	note := &domain.MockNotifier{}
+	uc := NewPollUseCase(gl, note, &domain.MockCache{})
+
+	_ = uc.PollOnce(context.Background(), domain.ProjectRef{ProjectID: 42, Ref: "v*", Tag: true})
+
+	want := "✅ CI: success · v1.4.0|Pipeline #9 (v1.4.0)|"
+	if len(note.Messages) != 1 || note.Messages[0] != want {
+		t.Errorf("unexpected notification %q", note.Messages)
+	}
+}
+
+func TestPollOnce_PathInBody(t *testing.T) {
+	gl := &domain.MockGitLab{Pipeline: domain.Pipeline{ID: 5, Ref: "main", Status: domain.StatusFailed}}
+	note := &domain.MockNotifier{}
+	uc := NewPollUseCase(gl, note, &domain.MockCache{})
+
+	_ = uc.PollOnce(context.Background(), domain.ProjectRef{Path: "team/api", Name: "api", Ref: "main"})
+
+	want := "❌ CI: failed|team/api · Pipeline #5 (main)|"
+	if len(note.Messages) != 1 || note.Messages[0] != want {
+		t.Errorf("unexpected notification %q", note.Messages)
+	}
+}
+
+func TestPollOnce_StylePerStatus(t *testing.T) {
+	gl := &domain.MockGitLab{Pipeline: domain.Pipeline{ID: 1, Ref: "main", Status: domain.StatusRunning, WebURL: "u"}}
+	note := &domain.MockNotifier{}
+	uc := NewPollUseCase(gl, note, &domain.MockCache{})
+	pr := domain.ProjectRef{ProjectID: 42, Ref: "main", Name: "core"}
+
+	for _, st := range []domain.PipelineStatus{domain.StatusRunning, domain.StatusFailed, domain.StatusSuccess} {
+		gl.Pipeline.Status = st
+		_ = uc.PollOnce(context.Background(), pr)
+	}
+
+	if len(note.Notifications) != 3 {
+		t.Fatalf("expected 3 notifications, got %d", len(note.Notifications))
+	}
+	running, failed, success := note.Notifications[0], note.Notifications[1], note.Notifications[2]
+	if !running.Silent || running.Retryable || running.Project != "core" {
+		t.Errorf("unexpected running notification %+v", running)
+	}
+	if failed.Severity != domain.SeverityCritical || !failed.Sticky || !failed.Retryable || failed.Category != "x-ci-watcher.failed" {
+		t.Errorf("unexpected failed notification %+v", failed)
+	}
+	if success.Expire != 5*time.Second || success.Sticky {
+		t.Errorf("unexpected success notification %+v", success)
+	}
+}
+
+func TestPollOnce_FailureTransitions(t *testing.T) {
+	gl := &domain.MockGitLab{}
+	note := &domain.MockNotifier{}
+	uc := NewPollUseCase(gl, note, &domain.MockCache{})
+	uc.SetRules(NewRules([]domain.Event{domain.EventFailed, domain.EventStillFailing, domain.EventRecovered}), nil)
+	pr := domain.ProjectRef{ProjectID: 42, Ref: "main"}
+
+	for i, st := range []domain.PipelineStatus{
+		domain.StatusSuccess,
+		domain.StatusRunning, domain.StatusFailed,
+		domain.StatusRunning, domain.StatusFailed,
+		domain.StatusRunning, domain.StatusSuccess,
+		domain.StatusRunning, domain.StatusSuccess,
+	} {
+		gl.Pipeline = domain.Pipeline{ID: int64(i/2 + 1), Ref: "main", Status: st}
+		_ = uc.PollOnce(context.Background(), pr)
+	}
+
+	var got []domain.Event
+	for _, n := range note.Notifications {
+		got = append(got, n.Event)
+	}
+	want := []domain.Event{domain.EventFailed, domain.EventStillFailing, domain.EventRecovered}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if note.Notifications[2].Title != "✅ CI: recovered" {
+		t.Errorf("unexpected title %q", note.Notifications[2].Title)
+	}
+}
+
+func TestPollOnce_SilentStartAndProjectRules(t *testing.T) {
+	gl := &domain.MockGitLab{Pipeline: domain.Pipeline{ID: 1, Ref: "release/1", Status: domain.StatusFailed}}
+	note := &domain.MockNotifier{}
+	uc := NewPollUseCase(gl, note, &domain.MockCache{})
+	uc.SetSilentStart(true)
+	uc.SetRules(NewRules([]domain.Event{domain.EventFailed}), map[domain.ProjectRef]Rules{
+		{ProjectID: 42, Ref: "release/*"}: NewRules([]domain.Event{domain.Event(domain.StatusRunning)}),
+	})
+	pr := domain.ProjectRef{ProjectID: 42, Ref: "release/1"}
+
+	_ = uc.PollOnce(context.Background(), pr)
+	if len(note.Messages) != 0 {
+		t.Fatalf("expected first poll to be silent, got %v", note.Messages)
+	}
+
+	gl.Pipeline = domain.Pipeline{ID: 2, Ref: "release/1", Status: domain.StatusRunning}
+	_ = uc.PollOnce(context.Background(), pr)
+	gl.Pipeline.Status = domain.StatusFailed
+	_ = uc.PollOnce(context.Background(), pr)
+
+	if len(note.Notifications) != 1 || note.Notifications[0].Event != domain.Event(domain.StatusRunning) {
+		t.Errorf("expected only the glob project's running rule to fire, got %v", note.Messages)
+	}
+}
+
+func TestPollOnce_QuietHoursDigest(t *testing.T) {
+	gl := &domain.MockGitLab{}
+	note := &domain.MockNotifier{}
+	cache := &domain.MockCache{}
+	uc := NewPollUseCase(gl, note, cache)
+	ctx := context.Background()
+	core := domain.ProjectRef{ProjectID: 1, Ref: "main", Name: "core"}
+	web := domain.ProjectRef{ProjectID: 2, Ref: "dev", Name: "web"}
+
+	uc.SetQuiet(ctx, true, true)
+	for _, step := range []struct {
+		pr domain.ProjectRef
+		p  domain.Pipeline
+	}{
+		{core, domain.Pipeline{ID: 1, Ref: "main", Status: domain.StatusRunning}},
+		{web, domain.Pipeline{ID: 5, Ref: "dev", Status: domain.StatusSuccess, WebURL: "w"}},
+		{core, domain.Pipeline{ID: 1, Ref: "main", Status: domain.StatusFailed}},
+	} {
+		gl.Pipeline = step.p
+		_ = uc.PollOnce(ctx, step.pr)
+	}
+
+	if len(note.Notifications) != 0 {
+		t.Fatalf("expected nothing while quiet, got %v", note.Messages)
+	}
+	if len(cache.Snapshots) != 3 {
+		t.Errorf("expected the cache to keep updating, got %d snapshots", len(cache.Snapshots))
+	}
+
+	uc.SetQuiet(ctx, false, true)
+	if len(note.Notifications) != 1 {
+		t.Fatalf("expected one digest, got %v", note.Messages)
+	}
+	d := note.Notifications[0]
+	if d.Title != "🌙 CI: 2 updates during quiet hours" || d.Body != "core · main: failed\nweb · dev: success" {
+		t.Errorf("unexpected digest %q / %q", d.Title, d.Body)
+	}
+	if d.Status != domain.StatusFailed || !d.Sticky {
+		t.Errorf("expected the digest styled as its worst status, got %+v", d)
+	}
+
+	uc.SetQuiet(ctx, false, true)
+	if len(note.Notifications) != 1 {
+		t.Errorf("expected the digest to be sent once, got %d", len(note.Notifications))
+	}
+}
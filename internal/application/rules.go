@@ -0,0 +1,38 @@
+package application
+
+import "github.com/davarch/ci-watcher/internal/domain"
+
+// Rules decide which pipeline transitions notify. The zero value notifies
+// on every transition.
+type Rules struct {
+	events map[domain.Event]bool
+}
+
+// NewRules notifies only on events; an empty list notifies on everything.
+func NewRules(events []domain.Event) Rules {
+	if len(events) == 0 {
+		return Rules{}
+	}
+	r := Rules{events: make(map[domain.Event]bool, len(events))}
+	for _, e := range events {
+		r.events[e] = true
+	}
+	return r
+}
+
+func (r Rules) Allows(e domain.Event) bool {
+	return r.events == nil || r.events[e]
+}
+
+// transition names the event of p given the last finished status of its
+// ref, which is success, failed or empty.
+func transition(settled domain.PipelineStatus, p domain.Pipeline) domain.Event {
+	switch {
+	case p.Status == domain.StatusFailed && settled == domain.StatusFailed:
+		return domain.EventStillFailing
+	case p.Status == domain.StatusSuccess && settled == domain.StatusFailed:
+		return domain.EventRecovered
+	default:
+		return domain.Event(p.Status)
+	}
+}
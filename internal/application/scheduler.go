@@ -2,82 +2,669 @@ package application
 
 import (
 	"context"
+	"errors"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/davarch/ci-watcher/internal/domain"
 	"go.uber.org/zap"
 )
 
+var (
+	ErrUnknownProject = errors.New("unknown project")
+	ErrPollQueued     = errors.New("poll already queued")
+)
+
+const (
+	defaultInterval         = 20 * time.Second
+	defaultConcurrency      = 4
+	defaultDiscoverInterval = 2 * time.Minute
+)
+
+// Adaptive polls projects with an active pipeline every Active and backs
+// idle ones off to at least Idle.
+type Adaptive struct {
+	Enabled bool
+	Active  time.Duration
+	Idle    time.Duration
+}
+
+// Settings is everything that can change on config reload.
+type Settings struct {
+	Refs      []domain.ProjectRef
+	Every     time.Duration
+	PauseFile string
+	// Intervals overrides Every for individual projects. A key whose Ref
+	// is a glob applies to every branch it matches.
+	Intervals map[domain.ProjectRef]time.Duration
+	Adaptive  Adaptive
+	// Concurrency bounds how many projects are polled at once.
+	Concurrency int
+	// Rules decide which transitions notify; ProjectRules override them
+	// per project like Intervals.
+	Rules        Rules
+	ProjectRules map[domain.ProjectRef]Rules
+	// SilentStart keeps the first poll round after startup, including the
+	// first discovery pass, quiet.
+	SilentStart bool
+	// Quiet lists when to poll without notifying.
+	Quiet domain.QuietHours
+	// Styles presents notifications per status; nil means the defaults.
+	Styles map[domain.PipelineStatus]domain.NotificationStyle
+	// Sources add refs discovered at runtime to Refs, refreshed every
+	// DiscoverEvery.
+	Sources       []domain.RefSource
+	DiscoverEvery time.Duration
+	// Gitlab replaces the use case's client when non-nil.
+	Gitlab domain.GitlabClient
+}
+
 type Scheduler struct {
-	log       *zap.Logger
-	use       *PollUseCase
+	log   *zap.Logger
+	use   *PollUseCase
+	clock Clock
+
+	running  atomic.Bool
+	paused   atomic.Bool
+	pollNow  chan []domain.ProjectRef
+	reloaded chan struct{}
+	wake     chan struct{}
+	wg       sync.WaitGroup
+
+	mu        sync.RWMutex
+	refs      []domain.ProjectRef
 	every     time.Duration
+	intervals map[domain.ProjectRef]time.Duration
+	adaptive  Adaptive
 	pauseFile string
+	quiet     domain.QuietHours
+	sem       chan struct{}
+	inflight  map[domain.ProjectRef]struct{}
+	due       map[domain.ProjectRef]time.Time
+
+	sources       []domain.RefSource
+	discoverEvery time.Duration
+	discovered    [][]domain.ProjectRef
+	// stale holds refs discovered before a reload until the next full
+	// discovery pass.
+	stale       []domain.ProjectRef
+	discovering bool
+	// discoveredOnce is set after the first discovery pass; until then the
+	// cache may hold refs from before a restart that are still watched.
+	discoveredOnce bool
+	nextDiscover   time.Time
+	generation     int
+	// started is set once every ref known after the first discovery pass
+	// has been polled.
+	started bool
+}
+
+func NewScheduler(l *zap.Logger, u *PollUseCase, st Settings) *Scheduler {
+	s := &Scheduler{
+		log: l, use: u, clock: realClock{},
+		pollNow:  make(chan []domain.ProjectRef, 8),
+		reloaded: make(chan struct{}, 1),
+		wake:     make(chan struct{}, 1),
+		inflight: make(map[domain.ProjectRef]struct{}),
+		due:      make(map[domain.ProjectRef]time.Time),
+	}
+	s.apply(st)
+	u.SetWatching(s.watches)
+	return s
+}
+
+// Reload swaps settings atomically. A running loop forgets all due times
+// and polls right away; no new loop is started.
+func (s *Scheduler) Reload(st Settings) {
+	s.apply(st)
+	s.log.Info("config reloaded",
+		zap.Int("projects", len(st.Refs)),
+		zap.Duration("every", st.Every),
+		zap.String("pause_file", st.PauseFile),
+	)
+
+	select {
+	case s.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) apply(st Settings) {
+	if st.Gitlab != nil {
+		s.use.SetGitlab(st.Gitlab)
+	}
+	s.use.SetRules(st.Rules, st.ProjectRules)
+	s.use.SetSilentStart(st.SilentStart)
+	s.use.SetStyles(st.Styles)
 
-	mu   sync.RWMutex
-	refs []domain.ProjectRef
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs = st.Refs
+	s.every = st.Every
+	s.intervals = st.Intervals
+	s.adaptive = st.Adaptive
+	s.pauseFile = st.PauseFile
+	s.quiet = st.Quiet
+
+	s.sources = st.Sources
+	s.discoverEvery = st.DiscoverEvery
+	if s.discoverEvery <= 0 {
+		s.discoverEvery = defaultDiscoverInterval
+	}
+	// Sources cannot be matched across a reload, so keep everything
+	// discovered so far as stale until the new sources have run once;
+	// otherwise a reload drops and re-notifies every discovered ref.
+	for _, found := range s.discovered {
+		for _, pr := range found {
+			if !slices.Contains(s.stale, pr) {
+				s.stale = append(s.stale, pr)
+			}
+		}
+	}
+	s.discovered = make([][]domain.ProjectRef, len(st.Sources))
+	if len(st.Sources) == 0 {
+		s.stale = nil
+	}
+	s.nextDiscover = time.Time{}
+	s.generation++
+
+	n := st.Concurrency
+	if n <= 0 {
+		n = defaultConcurrency
+	}
+	if cap(s.sem) != n {
+		s.sem = make(chan struct{}, n)
+	}
+}
+
+// snapshotRefs returns the static refs followed by every discovered one,
+// without duplicates.
+func (s *Scheduler) snapshotRefs() []domain.ProjectRef {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.allRefs()
+}
+
+// allRefs is snapshotRefs for callers holding mu.
+func (s *Scheduler) allRefs() []domain.ProjectRef {
+	seen := make(map[domain.ProjectRef]struct{}, len(s.refs))
+	refs := make([]domain.ProjectRef, 0, len(s.refs))
+	add := func(pr domain.ProjectRef) {
+		if _, ok := seen[pr]; !ok {
+			seen[pr] = struct{}{}
+			refs = append(refs, pr)
+		}
+	}
+	for _, pr := range s.refs {
+		add(pr)
+	}
+	for _, found := range s.discovered {
+		for _, pr := range found {
+			add(pr)
+		}
+	}
+	for _, pr := range s.stale {
+		add(pr)
+	}
+	return refs
 }
 
-func NewScheduler(l *zap.Logger, u *PollUseCase, refs []domain.ProjectRef, every time.Duration, pauseFile string) *Scheduler {
-	return &Scheduler{
-		log: l, use: u, refs: refs, every: every, pauseFile: pauseFile,
+// watches reports whether pr is watched right now, so a ref's results are
+// kept as soon as it is published and dropped as soon as it is removed.
+func (s *Scheduler) watches(pr domain.ProjectRef) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if slices.Contains(s.refs, pr) || slices.Contains(s.stale, pr) {
+		return true
+	}
+	for _, found := range s.discovered {
+		if slices.Contains(found, pr) {
+			return true
+		}
 	}
+	return false
 }
 
-func (s *Scheduler) UpdateRefs(refs []domain.ProjectRef) {
+// discover refreshes all sources in the background when due and returns
+// how long until the next refresh.
+func (s *Scheduler) discover(ctx context.Context, now time.Time) time.Duration {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.refs = refs
-	s.log.Info("config reloaded", zap.Int("projects", len(refs)))
+
+	if len(s.sources) == 0 {
+		return s.discoverEvery
+	}
+	if s.discovering {
+		return s.discoverEvery
+	}
+	if wait := s.nextDiscover.Sub(now); wait > 0 {
+		return wait
+	}
+
+	s.discovering = true
+	sources, gen := s.sources, s.generation
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		found := make([][]domain.ProjectRef, len(sources))
+		failed := make([]bool, len(sources))
+		for i, src := range sources {
+			refs, err := src.Refs(ctx)
+			if err != nil {
+				s.log.Warn("ref discovery failed", zap.Error(err))
+				failed[i] = true
+				continue
+			}
+			found[i] = refs
+		}
+
+		s.mu.Lock()
+		s.discovering = false
+		// Results of a pass overtaken by a reload are dropped, and the
+		// next tick re-runs the new sources right away.
+		if gen == s.generation {
+			s.discoveredOnce = true
+			s.nextDiscover = s.clock.Now().Add(s.discoverEvery)
+			for i := range found {
+				// Keep the last known refs of a source that failed, so a
+				// transient error does not drop watched merge requests.
+				if !failed[i] {
+					s.discovered[i] = found[i]
+				}
+			}
+			// Refs from before a reload that no source returned are gone,
+			// even when a source failed: it may never succeed again.
+			s.stale = nil
+		}
+		s.mu.Unlock()
+
+		s.retain(ctx)
+		s.checkStarted()
+		s.wakeUp()
+	}()
+
+	return s.discoverEvery
+}
+
+func (s *Scheduler) interval() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.every <= 0 {
+		return defaultInterval
+	}
+	return s.every
+}
+
+// intervalFor returns how long to wait before polling pr again, based on
+// its own interval and, in adaptive mode, on its last pipeline status.
+func (s *Scheduler) intervalFor(pr domain.ProjectRef) time.Duration {
+	base := s.interval()
+
+	s.mu.RLock()
+	if d := s.projectInterval(pr); d > 0 {
+		base = d
+	}
+	ad := s.adaptive
+	s.mu.RUnlock()
+
+	if !ad.Enabled {
+		return base
+	}
+	if p, ok := s.use.Last(pr); ok && p.Status.Active() && ad.Active > 0 {
+		return ad.Active
+	}
+	if ad.Idle > base {
+		return ad.Idle
+	}
+	return base
 }
 
+// projectInterval looks pr up in intervals, falling back to a glob entry
+// for the same project. Callers hold mu.
+func (s *Scheduler) projectInterval(pr domain.ProjectRef) time.Duration {
+	if d, ok := s.intervals[pr]; ok {
+		return d
+	}
+	for k, d := range s.intervals {
+		if k.Covers(pr) {
+			return d
+		}
+	}
+	return 0
+}
+
+func (s *Scheduler) pausePath() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pauseFile
+}
+
+// Run polls until ctx is cancelled. Only one loop may run at a time;
+// further calls return immediately.
 func (s *Scheduler) Run(ctx context.Context) {
-	t := time.NewTicker(s.every)
-	defer t.Stop()
+	if !s.running.CompareAndSwap(false, true) {
+		s.log.Warn("scheduler already running")
+		return
+	}
+	defer s.running.Store(false)
+	defer s.wg.Wait()
+
+	s.retain(ctx)
 
-	s.tick(ctx)
+	t := s.clock.NewTimer(0)
+	defer t.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-t.C:
-			s.tick(ctx)
+		case <-t.C():
+		case <-s.wake:
+		case <-s.reloaded:
+			s.retain(ctx)
+			s.mu.Lock()
+			clear(s.due)
+			s.mu.Unlock()
+		case refs := <-s.pollNow:
+			s.updateQuiet(ctx)
+			s.poll(ctx, refs)
+		}
+
+		t.Reset(s.tick(ctx))
+	}
+}
+
+// Pause stops polling until Resume. When a pause file is configured it is
+// the single source of truth, so other readers (e.g. the waybar command)
+// and manual touch/rm keep working.
+func (s *Scheduler) Pause() error {
+	s.log.Info("paused")
+	defer s.wakeUp()
+	pauseFile := s.pausePath()
+	if pauseFile == "" {
+		s.paused.Store(true)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(pauseFile), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(pauseFile, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Resume restarts polling right away; refs that came due while paused are
+// polled at once.
+func (s *Scheduler) Resume() error {
+	s.log.Info("resumed")
+	defer s.wakeUp()
+	pauseFile := s.pausePath()
+	if pauseFile == "" {
+		s.paused.Store(false)
+		return nil
+	}
+	if err := os.Remove(pauseFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// PollNow queues an immediate poll of every watched project, or of the one
+// whose name, path, project id, "id:ref", "path:ref" or "id!iid" equals
+// target. It ignores pause.
+func (s *Scheduler) PollNow(target string) error {
+	refs := s.snapshotRefs()
+	if target != "" {
+		var match []domain.ProjectRef
+		for _, pr := range refs {
+			id := strconv.FormatInt(pr.ProjectID, 10)
+			mr := id + "!" + strconv.FormatInt(pr.MergeRequest, 10)
+			if pr.Name == target || id == target || id+":"+pr.Ref == target || (pr.MergeRequest > 0 && mr == target) ||
+				(pr.Path != "" && (pr.Path == target || pr.Path+":"+pr.Ref == target)) {
+				match = append(match, pr)
+			}
+		}
+		if len(match) == 0 {
+			return ErrUnknownProject
+		}
+		refs = match
+	}
+
+	select {
+	case s.pollNow <- refs:
+		return nil
+	default:
+		return ErrPollQueued
+	}
+}
+
+type ProjectStatus struct {
+	Name         string `json:"name"`
+	Instance     string `json:"instance,omitempty"`
+	ProjectID    int64  `json:"project_id"`
+	Path         string `json:"path,omitempty"`
+	Ref          string `json:"ref"`
+	MergeRequest int64  `json:"merge_request,omitempty"`
+	Pipeline     int64  `json:"pipeline_id"`
+	Status       string `json:"status"`
+	URL          string `json:"url"`
+	NextPoll     int64  `json:"next_poll,omitempty"`
+}
+
+type Status struct {
+	Paused   bool            `json:"paused"`
+	Quiet    bool            `json:"quiet,omitempty"`
+	Projects []ProjectStatus `json:"projects"`
+}
+
+func (s *Scheduler) Status() Status {
+	st := Status{Paused: s.isPaused(), Quiet: s.use.Quiet()}
+	for _, pr := range s.snapshotRefs() {
+		ps := ProjectStatus{Name: pr.Name, Instance: pr.Instance, ProjectID: pr.ProjectID, Path: pr.Path, Ref: pr.Ref, MergeRequest: pr.MergeRequest}
+		if p, ok := s.use.Last(pr); ok {
+			ps.Pipeline, ps.Status, ps.URL = p.ID, string(p.Status), p.WebURL
+			if ps.Ref == "" && !pr.Tag {
+				ps.Ref = p.Ref
+			}
+		}
+		s.mu.RLock()
+		if d, ok := s.due[pr]; ok {
+			ps.NextPoll = d.Unix()
 		}
+		s.mu.RUnlock()
+		st.Projects = append(st.Projects, ps)
 	}
+	return st
 }
 
-func (s *Scheduler) tick(ctx context.Context) {
+// tick starts polls for every project that is due and returns how long to
+// sleep until the next one is.
+func (s *Scheduler) tick(ctx context.Context) time.Duration {
+	s.updateQuiet(ctx)
 	if s.isPaused() {
 		s.log.Debug("paused: skipping poll")
-		return
+		return s.interval()
+	}
+
+	now := s.clock.Now()
+	nextDiscover := s.discover(ctx, now)
+	refs := s.snapshotRefs()
+
+	var due []domain.ProjectRef
+	s.mu.RLock()
+	for _, pr := range refs {
+		if _, busy := s.inflight[pr]; busy {
+			continue
+		}
+		if at, ok := s.due[pr]; !ok || !at.After(now) {
+			due = append(due, pr)
+		}
+	}
+	s.mu.RUnlock()
+
+	s.poll(ctx, due)
+
+	next := s.interval()
+	s.mu.RLock()
+	for _, pr := range refs {
+		if _, busy := s.inflight[pr]; busy {
+			continue
+		}
+		if at, ok := s.due[pr]; ok && at.Sub(now) < next {
+			next = at.Sub(now)
+		}
+	}
+	s.mu.RUnlock()
+
+	if nextDiscover < next {
+		next = nextDiscover
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+// updateQuiet starts or ends quiet hours; ending them may send a digest.
+func (s *Scheduler) updateQuiet(ctx context.Context) {
+	s.mu.RLock()
+	q := s.quiet
+	s.mu.RUnlock()
+
+	quiet := q.Active(s.clock.Now())
+	if quiet != s.use.Quiet() {
+		s.log.Info("quiet hours", zap.Bool("quiet", quiet))
 	}
-	s.runAll(ctx)
+	s.use.SetQuiet(ctx, quiet, q.Digest)
 }
 
 func (s *Scheduler) isPaused() bool {
-	if s.pauseFile == "" {
-		return false
+	pauseFile := s.pausePath()
+	if pauseFile == "" {
+		return s.paused.Load()
 	}
-	_, err := os.Stat(s.pauseFile)
+	_, err := os.Stat(pauseFile)
 	return err == nil
 }
 
-func (s *Scheduler) runAll(ctx context.Context) {
+// retain drops state of refs no longer watched. It waits for the first
+// discovery pass, so a restart keeps discovered refs in the cache.
+func (s *Scheduler) retain(ctx context.Context) {
 	s.mu.RLock()
-	refs := make([]domain.ProjectRef, len(s.refs))
-	copy(refs, s.refs)
+	waiting := len(s.sources) > 0 && !s.discoveredOnce
 	s.mu.RUnlock()
+	if waiting {
+		return
+	}
+
+	refs := s.snapshotRefs()
+	if err := s.use.Retain(ctx, refs); err != nil {
+		s.log.Warn("cache retain failed", zap.Error(err))
+	}
+
+	keep := make(map[domain.ProjectRef]struct{}, len(refs))
+	for _, pr := range refs {
+		keep[pr] = struct{}{}
+	}
+	s.mu.Lock()
+	for pr := range s.due {
+		if _, ok := keep[pr]; !ok {
+			delete(s.due, pr)
+		}
+	}
+	s.mu.Unlock()
+}
 
+// poll starts a worker per ref and returns without waiting, so a slow
+// project never delays the others. At most Concurrency polls run at once
+// and a ref still in flight is skipped rather than queued twice. When a
+// worker finishes it schedules the ref's next poll and wakes the loop.
+func (s *Scheduler) poll(ctx context.Context, refs []domain.ProjectRef) {
+	s.mu.Lock()
+	sem := s.sem
+	var start []domain.ProjectRef
 	for _, pr := range refs {
-		if err := s.use.PollOnce(ctx, pr); err != nil {
-			s.log.Warn("poll failed",
+		if _, busy := s.inflight[pr]; busy {
+			s.log.Debug("poll still in flight: skipping",
 				zap.Int64("project", pr.ProjectID),
 				zap.String("ref", pr.Ref),
-				zap.Error(err),
 			)
+			continue
 		}
+		s.inflight[pr] = struct{}{}
+		start = append(start, pr)
+	}
+	s.mu.Unlock()
+
+	for _, pr := range start {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.finish(pr)
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			if err := s.use.PollOnce(ctx, pr); err != nil {
+				s.log.Warn("poll failed",
+					zap.Int64("project", pr.ProjectID),
+					zap.String("ref", pr.Ref),
+					zap.Error(err),
+				)
+			}
+		}()
+	}
+}
+
+func (s *Scheduler) finish(pr domain.ProjectRef) {
+	next := s.clock.Now().Add(s.intervalFor(pr))
+
+	s.mu.Lock()
+	delete(s.inflight, pr)
+	s.due[pr] = next
+	s.mu.Unlock()
+
+	s.checkStarted()
+	s.wakeUp()
+}
+
+// checkStarted ends the use case's startup once the first discovery pass
+// is done and every ref has been polled.
+func (s *Scheduler) checkStarted() {
+	s.mu.Lock()
+	done := !s.started && (len(s.sources) == 0 || s.discoveredOnce)
+	for _, pr := range s.allRefs() {
+		if _, ok := s.due[pr]; !ok {
+			done = false
+			break
+		}
+	}
+	s.started = s.started || done
+	s.mu.Unlock()
+
+	if done {
+		s.use.EndStartup()
+	}
+}
+
+// wakeUp makes the run loop re-check due refs and the pause state now.
+func (s *Scheduler) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
 	}
 }
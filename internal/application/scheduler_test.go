@@ -0,0 +1,760 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+	"go.uber.org/zap"
+)
+
+func TestScheduler_PauseResumeUsesPauseFile(t *testing.T) {
+	pause := filepath.Join(t.TempDir(), "paused")
+	uc := NewPollUseCase(&domain.MockGitLab{}, &domain.MockNotifier{}, &domain.MockCache{})
+	s := NewScheduler(zap.NewNop(), uc, Settings{PauseFile: pause})
+
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Status().Paused {
+		t.Error("expected paused")
+	}
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Status().Paused {
+		t.Error("expected resumed")
+	}
+}
+
+func TestScheduler_PollNowMatchesTarget(t *testing.T) {
+	uc := NewPollUseCase(&domain.MockGitLab{}, &domain.MockNotifier{}, &domain.MockCache{})
+	refs := []domain.ProjectRef{{ProjectID: 1, Ref: "main", Name: "core"}, {ProjectID: 2, Ref: "dev"}}
+	s := NewScheduler(zap.NewNop(), uc, Settings{Refs: refs})
+
+	if err := s.PollNow("nope"); err != ErrUnknownProject {
+		t.Fatalf("expected ErrUnknownProject, got %v", err)
+	}
+	if err := s.PollNow("core"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-s.pollNow; len(got) != 1 || got[0].ProjectID != 1 {
+		t.Errorf("unexpected refs %+v", got)
+	}
+	if err := s.PollNow("2:dev"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-s.pollNow; len(got) != 1 || got[0].ProjectID != 2 {
+		t.Errorf("unexpected refs %+v", got)
+	}
+	if err := s.PollNow(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-s.pollNow; len(got) != 2 {
+		t.Errorf("expected all refs, got %+v", got)
+	}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	c     chan time.Time
+	at    time.Time
+	armed bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	select {
+	case <-t.c:
+	default:
+	}
+	t.at, t.armed = t.clock.now.Add(d), true
+	t.clock.fire()
+}
+
+func (t *fakeTimer) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.armed = false
+	t.clock.stopped++
+}
+
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	stopped int
+}
+
+func newFakeClock() *fakeClock { return &fakeClock{now: time.Unix(1_700_000_000, 0)} }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d), armed: true}
+	c.timers = append(c.timers, t)
+	c.fire()
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+func (c *fakeClock) fire() {
+	for _, t := range c.timers {
+		if t.armed && !t.at.After(c.now) {
+			t.armed = false
+			select {
+			case t.c <- c.now:
+			default:
+			}
+		}
+	}
+}
+
+func (c *fakeClock) counts() (created, stopped int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers), c.stopped
+}
+
+type scriptedGitLab struct {
+	mu     sync.Mutex
+	status map[int64]domain.PipelineStatus
+	calls  map[int64]int
+}
+
+func newScriptedGitLab(status map[int64]domain.PipelineStatus) *scriptedGitLab {
+	return &scriptedGitLab{status: status, calls: make(map[int64]int)}
+}
+
+func (g *scriptedGitLab) LatestPipeline(_ context.Context, pr domain.ProjectRef) (domain.Pipeline, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls[pr.ProjectID]++
+	st, ok := g.status[pr.ProjectID]
+	if !ok {
+		st = domain.StatusSuccess
+	}
+	return domain.Pipeline{ID: 1, Ref: pr.Ref, Status: st}, nil
+}
+
+// take returns and resets the number of calls per project.
+func (g *scriptedGitLab) take() map[int64]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := g.calls
+	g.calls = make(map[int64]int)
+	return out
+}
+
+func startScheduler(t *testing.T, s *Scheduler) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Run not cancelled by context")
+		}
+	}
+}
+
+// settle waits for in-flight polls to finish and the loop to re-arm.
+func settle(t *testing.T, s *Scheduler) {
+	t.Helper()
+	time.Sleep(10 * time.Millisecond)
+	waitInflight(t, s, 0)
+	for len(s.wake) > 0 || len(s.reloaded) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestScheduler_ReloadKeepsSingleLoop(t *testing.T) {
+	clock := newFakeClock()
+	gl := newScriptedGitLab(nil)
+	uc := NewPollUseCase(gl, &domain.MockNotifier{}, &domain.MockCache{})
+	ref := domain.ProjectRef{ProjectID: 1, Ref: "main"}
+
+	s := NewScheduler(zap.NewNop(), uc, Settings{Refs: []domain.ProjectRef{ref}, Every: time.Second})
+	s.clock = clock
+	stop := startScheduler(t, s)
+
+	settle(t, s)
+	if n := gl.take()[1]; n != 1 {
+		t.Fatalf("expected initial poll, got %d", n)
+	}
+
+	second := make(chan struct{})
+	go func() {
+		s.Run(context.Background())
+		close(second)
+	}()
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("second Run did not return")
+	}
+
+	gl2 := newScriptedGitLab(nil)
+	for i := 1; i <= 50; i++ {
+		s.Reload(Settings{Refs: []domain.ProjectRef{ref}, Every: time.Duration(i) * time.Minute, Gitlab: gl2})
+	}
+	settle(t, s)
+	gl2.take()
+
+	clock.Advance(49 * time.Minute)
+	settle(t, s)
+	if n := gl2.take()[1]; n != 0 {
+		t.Errorf("polled %d times before the new interval elapsed", n)
+	}
+
+	clock.Advance(time.Minute)
+	settle(t, s)
+	if n := gl2.take()[1]; n != 1 {
+		t.Errorf("expected exactly one poll per interval, got %d", n)
+	}
+	if n := gl.take()[1]; n != 0 {
+		t.Errorf("old client still used after reload: %d calls", n)
+	}
+
+	stop()
+	if created, stopped := clock.counts(); created != 1 || stopped != 1 {
+		t.Errorf("expected a single timer created and stopped, got %d/%d", created, stopped)
+	}
+}
+
+func TestScheduler_PerProjectIntervals(t *testing.T) {
+	clock := newFakeClock()
+	gl := newScriptedGitLab(nil)
+	uc := NewPollUseCase(gl, &domain.MockNotifier{}, &domain.MockCache{})
+	fast := domain.ProjectRef{ProjectID: 1, Ref: "main"}
+	slow := domain.ProjectRef{ProjectID: 2, Ref: "main"}
+
+	s := NewScheduler(zap.NewNop(), uc, Settings{
+		Refs:      []domain.ProjectRef{fast, slow},
+		Every:     5 * time.Minute,
+		Intervals: map[domain.ProjectRef]time.Duration{fast: time.Minute},
+	})
+	s.clock = clock
+	stop := startScheduler(t, s)
+	defer stop()
+
+	settle(t, s)
+	gl.take()
+
+	for i := 0; i < 4; i++ {
+		clock.Advance(time.Minute)
+		settle(t, s)
+	}
+	if got := gl.take(); got[1] != 4 || got[2] != 0 {
+		t.Errorf("after 4m expected fast=4 slow=0, got %v", got)
+	}
+
+	clock.Advance(time.Minute)
+	settle(t, s)
+	if got := gl.take(); got[1] != 1 || got[2] != 1 {
+		t.Errorf("after 5m expected fast=1 slow=1, got %v", got)
+	}
+}
+
+func TestScheduler_AdaptivePollsRunningFaster(t *testing.T) {
+	clock := newFakeClock()
+	gl := newScriptedGitLab(map[int64]domain.PipelineStatus{1: domain.StatusRunning})
+	uc := NewPollUseCase(gl, &domain.MockNotifier{}, &domain.MockCache{})
+	running := domain.ProjectRef{ProjectID: 1, Ref: "main"}
+	idle := domain.ProjectRef{ProjectID: 2, Ref: "main"}
+
+	s := NewScheduler(zap.NewNop(), uc, Settings{
+		Refs:     []domain.ProjectRef{running, idle},
+		Every:    20 * time.Second,
+		Adaptive: Adaptive{Enabled: true, Active: 10 * time.Second, Idle: 2 * time.Minute},
+	})
+	s.clock = clock
+	stop := startScheduler(t, s)
+	defer stop()
+
+	settle(t, s)
+	gl.take()
+
+	for i := 0; i < 11; i++ {
+		clock.Advance(10 * time.Second)
+		settle(t, s)
+	}
+	if got := gl.take(); got[1] != 11 || got[2] != 0 {
+		t.Errorf("after 110s expected running=11 idle=0, got %v", got)
+	}
+
+	clock.Advance(10 * time.Second)
+	settle(t, s)
+	if got := gl.take(); got[1] != 1 || got[2] != 1 {
+		t.Errorf("after 2m expected running=1 idle=1, got %v", got)
+	}
+}
+
+type blockingGitLab struct {
+	calls   chan domain.ProjectRef
+	release map[int64]chan struct{}
+
+	lock         sync.Mutex
+	peak, active int
+}
+
+func (g *blockingGitLab) LatestPipeline(ctx context.Context, pr domain.ProjectRef) (domain.Pipeline, error) {
+	g.lock.Lock()
+	g.active++
+	if g.active > g.peak {
+		g.peak = g.active
+	}
+	g.lock.Unlock()
+	defer func() {
+		g.lock.Lock()
+		g.active--
+		g.lock.Unlock()
+	}()
+
+	g.calls <- pr
+	if ch, ok := g.release[pr.ProjectID]; ok {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return domain.Pipeline{}, ctx.Err()
+		}
+	}
+	return domain.Pipeline{ID: 1, Ref: pr.Ref, Status: domain.StatusSuccess}, nil
+}
+
+func TestScheduler_SlowProjectDoesNotDelayOthers(t *testing.T) {
+	gl := &blockingGitLab{
+		calls:   make(chan domain.ProjectRef, 64),
+		release: map[int64]chan struct{}{1: make(chan struct{})},
+	}
+	note := &domain.MockNotifier{}
+	uc := NewPollUseCase(gl, note, &domain.MockCache{})
+	refs := []domain.ProjectRef{{ProjectID: 1, Ref: "main"}, {ProjectID: 2, Ref: "main"}}
+	s := NewScheduler(zap.NewNop(), uc, Settings{Refs: refs, Concurrency: 2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.poll(ctx, refs)
+	seen := map[int64]int{}
+	for i := 0; i < 2; i++ {
+		seen[(<-gl.calls).ProjectID]++
+	}
+	waitInflight(t, s, 1)
+
+	s.poll(ctx, refs)
+	if pr := <-gl.calls; pr.ProjectID != 2 {
+		t.Fatalf("expected only project 2 to be polled again, got %d", pr.ProjectID)
+	}
+
+	close(gl.release[1])
+	s.wg.Wait()
+	if len(gl.calls) != 0 {
+		t.Errorf("project 1 polled twice while in flight")
+	}
+	if len(note.Messages) != 2 {
+		t.Errorf("expected 2 notifications, got %d", len(note.Messages))
+	}
+}
+
+func TestScheduler_ConcurrencyIsBounded(t *testing.T) {
+	gl := &blockingGitLab{calls: make(chan domain.ProjectRef, 64), release: map[int64]chan struct{}{}}
+	var refs []domain.ProjectRef
+	gate := make(chan struct{})
+	for i := int64(1); i <= 6; i++ {
+		gl.release[i] = gate
+		refs = append(refs, domain.ProjectRef{ProjectID: i, Ref: "main"})
+	}
+	uc := NewPollUseCase(gl, &domain.MockNotifier{}, &domain.MockCache{})
+	s := NewScheduler(zap.NewNop(), uc, Settings{Refs: refs, Concurrency: 2})
+
+	s.poll(context.Background(), refs)
+	<-gl.calls
+	<-gl.calls
+	time.Sleep(20 * time.Millisecond)
+	if n := len(gl.calls); n != 0 {
+		t.Fatalf("expected at most 2 concurrent polls, %d more started", n)
+	}
+
+	close(gate)
+	s.wg.Wait()
+	if gl.peak != 2 {
+		t.Errorf("expected peak concurrency 2, got %d", gl.peak)
+	}
+}
+
+func waitInflight(t *testing.T, s *Scheduler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.RLock()
+		got := len(s.inflight)
+		s.mu.RUnlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d polls in flight, got %d", n, got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestScheduler_DiscoveredRefsAreWatchedAndDropped(t *testing.T) {
+	clock := newFakeClock()
+	gl := newScriptedGitLab(nil)
+	cache := &domain.MockCache{}
+	uc := NewPollUseCase(gl, &domain.MockNotifier{}, cache)
+	static := domain.ProjectRef{ProjectID: 1, Ref: "main"}
+	mr := domain.ProjectRef{ProjectID: 2, Ref: "feature", MergeRequest: 7}
+
+	var (
+		mu   sync.Mutex
+		open = []domain.ProjectRef{mr}
+	)
+	src := domain.RefSourceFunc(func(context.Context) ([]domain.ProjectRef, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]domain.ProjectRef(nil), open...), nil
+	})
+
+	s := NewScheduler(zap.NewNop(), uc, Settings{
+		Refs:          []domain.ProjectRef{static},
+		Every:         time.Minute,
+		Sources:       []domain.RefSource{src},
+		DiscoverEvery: 5 * time.Minute,
+	})
+	s.clock = clock
+	stop := startScheduler(t, s)
+	defer stop()
+
+	settle(t, s)
+	if got := gl.take(); got[1] != 1 || got[2] != 1 {
+		t.Fatalf("expected static and discovered refs polled, got %v", got)
+	}
+
+	mu.Lock()
+	open = nil
+	mu.Unlock()
+
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Minute)
+		settle(t, s)
+	}
+	gl.take()
+
+	clock.Advance(time.Minute)
+	settle(t, s)
+	if got := gl.take(); got[1] != 1 || got[2] != 0 {
+		t.Errorf("expected closed merge request to be dropped, got %v", got)
+	}
+
+	if retained := cache.LastRetained(); len(retained) != 1 || retained[0] != static {
+		t.Errorf("expected cache to retain only the static ref, got %v", retained)
+	}
+}
+
+func TestScheduler_QuietHoursFollowClock(t *testing.T) {
+	clock := newFakeClock()
+	uc := NewPollUseCase(&domain.MockGitLab{}, &domain.MockNotifier{}, &domain.MockCache{})
+	at := clock.Now().UTC()
+	start := time.Duration(at.Hour()) * time.Hour
+
+	s := NewScheduler(zap.NewNop(), uc, Settings{Quiet: domain.QuietHours{
+		Location: time.UTC,
+		Windows:  []domain.QuietWindow{{Days: []time.Weekday{at.Weekday()}, From: start, To: start + time.Hour}},
+	}})
+	s.clock = clock
+
+	s.updateQuiet(context.Background())
+	if !uc.Quiet() || !s.Status().Quiet {
+		t.Fatal("expected quiet hours inside the window")
+	}
+
+	clock.Advance(time.Hour)
+	s.updateQuiet(context.Background())
+	if uc.Quiet() {
+		t.Error("expected quiet hours to end with the window")
+	}
+}
+
+func TestScheduler_ReloadRemovingEarlierSourceKeepsLaterRefs(t *testing.T) {
+	clock := newFakeClock()
+	gl := newScriptedGitLab(nil)
+	note := &domain.MockNotifier{}
+	cache := &domain.MockCache{}
+	uc := NewPollUseCase(gl, note, cache)
+	branch := domain.ProjectRef{ProjectID: 1, Ref: "release/1"}
+	mr := domain.ProjectRef{ProjectID: 2, Ref: "feature", MergeRequest: 7}
+
+	globSrc := domain.RefSourceFunc(func(context.Context) ([]domain.ProjectRef, error) {
+		return []domain.ProjectRef{branch}, nil
+	})
+	mrCalls := make(chan struct{}, 8)
+	mrSrc := domain.RefSourceFunc(func(context.Context) ([]domain.ProjectRef, error) {
+		mrCalls <- struct{}{}
+		return []domain.ProjectRef{mr}, nil
+	})
+
+	st := Settings{Every: time.Minute, DiscoverEvery: 5 * time.Minute, Sources: []domain.RefSource{globSrc, mrSrc}}
+	s := NewScheduler(zap.NewNop(), uc, st)
+	s.clock = clock
+	stop := startScheduler(t, s)
+	defer stop()
+
+	settle(t, s)
+	<-mrCalls
+	if got := gl.take(); got[1] != 1 || got[2] != 1 {
+		t.Fatalf("expected both discovered refs polled, got %v", got)
+	}
+	notified := len(note.Notifications)
+
+	st.Sources = []domain.RefSource{mrSrc}
+	s.Reload(st)
+	settle(t, s)
+	select {
+	case <-mrCalls:
+	case <-time.After(time.Second):
+		t.Fatal("expected discovery right after reload")
+	}
+	settle(t, s)
+
+	if refs := s.snapshotRefs(); len(refs) != 1 || refs[0] != mr {
+		t.Errorf("expected only the merge request to stay watched, got %v", refs)
+	}
+	if _, ok := uc.Last(mr); !ok {
+		t.Error("merge request state dropped on reload")
+	}
+	if len(note.Notifications) != notified {
+		t.Errorf("merge request re-notified after reload: %v", note.Messages[notified:])
+	}
+	if retained := cache.LastRetained(); len(retained) != 1 || retained[0] != mr {
+		t.Errorf("expected cache to retain only the merge request, got %v", retained)
+	}
+}
+
+func TestScheduler_ReloadToFailingSourceDropsStaleRefs(t *testing.T) {
+	clock := newFakeClock()
+	gl := newScriptedGitLab(nil)
+	cache := &domain.MockCache{}
+	uc := NewPollUseCase(gl, &domain.MockNotifier{}, cache)
+	mr := domain.ProjectRef{ProjectID: 2, Ref: "feature", MergeRequest: 7}
+
+	mrSrc := domain.RefSourceFunc(func(context.Context) ([]domain.ProjectRef, error) {
+		return []domain.ProjectRef{mr}, nil
+	})
+	calls := make(chan struct{}, 8)
+	emptySrc := domain.RefSourceFunc(func(context.Context) ([]domain.ProjectRef, error) {
+		return nil, nil
+	})
+	failingSrc := domain.RefSourceFunc(func(context.Context) ([]domain.ProjectRef, error) {
+		calls <- struct{}{}
+		return nil, errors.New("404 Not Found")
+	})
+
+	st := Settings{Every: time.Minute, DiscoverEvery: 5 * time.Minute, Sources: []domain.RefSource{mrSrc}}
+	s := NewScheduler(zap.NewNop(), uc, st)
+	s.clock = clock
+	stop := startScheduler(t, s)
+	defer stop()
+
+	settle(t, s)
+	if got := gl.take(); got[2] != 1 {
+		t.Fatalf("expected the merge request polled, got %v", got)
+	}
+
+	st.Sources = []domain.RefSource{emptySrc, failingSrc}
+	s.Reload(st)
+	settle(t, s)
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("expected discovery right after reload")
+	}
+	settle(t, s)
+
+	if refs := s.snapshotRefs(); len(refs) != 0 {
+		t.Errorf("expected stale refs dropped after a discovery pass, got %v", refs)
+	}
+	gl.take()
+	clock.Advance(time.Minute)
+	settle(t, s)
+	if got := gl.take(); got[2] != 0 {
+		t.Errorf("expected the merge request to stop being polled, got %v", got)
+	}
+	if retained := cache.LastRetained(); len(retained) != 0 {
+		t.Errorf("expected the merge request dropped from the cache, got %v", retained)
+	}
+}
+
+func TestScheduler_DiscoveredRefIsWatchedBeforeRetain(t *testing.T) {
+	uc := NewPollUseCase(newScriptedGitLab(nil), &domain.MockNotifier{}, &domain.MockCache{})
+	mr := domain.ProjectRef{ProjectID: 2, Ref: "feature", MergeRequest: 7}
+	src := domain.RefSourceFunc(func(context.Context) ([]domain.ProjectRef, error) { return nil, nil })
+
+	s := NewScheduler(zap.NewNop(), uc, Settings{Every: time.Minute, Sources: []domain.RefSource{src}})
+	_ = uc.Retain(context.Background(), nil)
+
+	// A tick between publishing a discovered ref and the retain that
+	// follows must keep the ref's result.
+	s.mu.Lock()
+	s.discovered[0] = []domain.ProjectRef{mr}
+	s.mu.Unlock()
+	if err := uc.PollOnce(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := uc.Last(mr); !ok {
+		t.Fatal("result of a newly discovered ref dropped")
+	}
+
+	s.mu.Lock()
+	s.discovered[0] = nil
+	s.mu.Unlock()
+	_ = uc.Retain(context.Background(), nil)
+	if err := uc.PollOnce(context.Background(), mr); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := uc.Last(mr); ok {
+		t.Error("result of a removed ref kept")
+	}
+}
+
+func TestScheduler_SilentStartOnlyCoversFirstRound(t *testing.T) {
+	clock := newFakeClock()
+	gl := newScriptedGitLab(map[int64]domain.PipelineStatus{1: domain.StatusFailed, 2: domain.StatusFailed, 3: domain.StatusFailed})
+	note := &domain.MockNotifier{}
+	uc := NewPollUseCase(gl, note, &domain.MockCache{})
+	static := domain.ProjectRef{ProjectID: 1, Ref: "main"}
+	mr := domain.ProjectRef{ProjectID: 2, Ref: "feature", MergeRequest: 7}
+	later := domain.ProjectRef{ProjectID: 3, Ref: "fix", MergeRequest: 8}
+
+	var mu sync.Mutex
+	found := []domain.ProjectRef{mr}
+	src := domain.RefSourceFunc(func(context.Context) ([]domain.ProjectRef, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return found, nil
+	})
+
+	s := NewScheduler(zap.NewNop(), uc, Settings{
+		Refs: []domain.ProjectRef{static}, Every: time.Minute, DiscoverEvery: 5 * time.Minute,
+		Sources: []domain.RefSource{src}, SilentStart: true,
+	})
+	s.clock = clock
+	stop := startScheduler(t, s)
+	defer stop()
+
+	settle(t, s)
+	settle(t, s)
+	if got := gl.take(); got[1] != 1 || got[2] != 1 {
+		t.Fatalf("expected the static ref and merge request polled, got %v", got)
+	}
+	if len(note.Notifications) != 0 {
+		t.Fatalf("expected the startup round to be silent, got %v", note.Messages)
+	}
+
+	mu.Lock()
+	found = []domain.ProjectRef{mr, later}
+	mu.Unlock()
+	clock.Advance(5 * time.Minute)
+	settle(t, s)
+	settle(t, s)
+
+	if len(note.Notifications) != 1 || note.Notifications[0].Pipeline.Ref != "fix" {
+		t.Errorf("expected only the merge request opened after startup to notify, got %v", note.Messages)
+	}
+}
+
+func TestScheduler_StartupKeepsCacheUntilDiscovery(t *testing.T) {
+	clock := newFakeClock()
+	cache := &domain.MockCache{}
+	uc := NewPollUseCase(newScriptedGitLab(nil), &domain.MockNotifier{}, cache)
+	static := domain.ProjectRef{ProjectID: 1, Ref: "main"}
+	mr := domain.ProjectRef{ProjectID: 2, Ref: "feature", MergeRequest: 7}
+
+	release := make(chan struct{})
+	src := domain.RefSourceFunc(func(ctx context.Context) ([]domain.ProjectRef, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return []domain.ProjectRef{mr}, nil
+	})
+
+	s := NewScheduler(zap.NewNop(), uc, Settings{
+		Refs: []domain.ProjectRef{static}, Every: time.Minute, Sources: []domain.RefSource{src},
+	})
+	s.clock = clock
+	stop := startScheduler(t, s)
+	defer stop()
+
+	settle(t, s)
+	if retained := cache.LastRetained(); retained != nil {
+		t.Fatalf("expected no retain before discovery, got %v", retained)
+	}
+
+	close(release)
+	settle(t, s)
+	if retained := cache.LastRetained(); len(retained) != 2 {
+		t.Errorf("expected static and discovered refs retained, got %v", retained)
+	}
+}
+
+func TestScheduler_ResumePollsWithoutWaitingForTimer(t *testing.T) {
+	clock := newFakeClock()
+	gl := newScriptedGitLab(nil)
+	uc := NewPollUseCase(gl, &domain.MockNotifier{}, &domain.MockCache{})
+	ref := domain.ProjectRef{ProjectID: 1, Ref: "main"}
+
+	s := NewScheduler(zap.NewNop(), uc, Settings{Refs: []domain.ProjectRef{ref}, Every: time.Minute})
+	s.clock = clock
+	stop := startScheduler(t, s)
+	defer stop()
+
+	settle(t, s)
+	gl.take()
+
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, s)
+	clock.Advance(time.Minute)
+	settle(t, s)
+	if n := gl.take()[1]; n != 0 {
+		t.Fatalf("expected no polls while paused, got %d", n)
+	}
+
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, s)
+	if n := gl.take()[1]; n != 1 {
+		t.Errorf("expected resume to poll the overdue ref at once, got %d", n)
+	}
+}
@@ -2,15 +2,19 @@ package domain
 
 import (
 	"context"
+	"sync"
 )
 
 type MockGitLab struct {
+	mu       sync.Mutex
 	Pipeline Pipeline
 	Err      error
 	Called   int
 }
 
 func (m *MockGitLab) LatestPipeline(ctx context.Context, ref ProjectRef) (Pipeline, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Called++
 	if m.Err != nil {
 		return Pipeline{}, m.Err
@@ -19,24 +23,49 @@ func (m *MockGitLab) LatestPipeline(ctx context.Context, ref ProjectRef) (Pipeli
 }
 
 type MockNotifier struct {
-	Messages []string
-	Err      error
+	mu            sync.Mutex
+	Messages      []string
+	Notifications []Notification
+	Err           error
 }
 
-func (n *MockNotifier) Notify(ctx context.Context, title, body, url string) error {
-	n.Messages = append(n.Messages, title+"|"+body+"|"+url)
+func (n *MockNotifier) Notify(ctx context.Context, note Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Messages = append(n.Messages, note.Title+"|"+note.Body+"|"+note.URL)
+	n.Notifications = append(n.Notifications, note)
 	return n.Err
 }
 
 type MockCache struct {
+	mu        sync.Mutex
 	Snapshots []Snapshot
+	Retained  []ProjectRef
 	Err       error
 }
 
 func (c *MockCache) Write(ctx context.Context, s Snapshot) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.Err != nil {
 		return c.Err
 	}
 	c.Snapshots = append(c.Snapshots, s)
 	return nil
 }
+
+func (c *MockCache) Retain(ctx context.Context, refs []ProjectRef) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Err != nil {
+		return c.Err
+	}
+	c.Retained = refs
+	return nil
+}
+
+func (c *MockCache) LastRetained() []ProjectRef {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Retained
+}
@@ -1,25 +1,338 @@
 package domain
 
+import (
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
 type PipelineStatus string
 
 const (
-	StatusSuccess   PipelineStatus = "success"
-	StatusFailed    PipelineStatus = "failed"
-	StatusRunning   PipelineStatus = "running"
-	StatusCancelled PipelineStatus = "cancelled"
-	StatusOther     PipelineStatus = "other"
+	StatusCreated            PipelineStatus = "created"
+	StatusWaitingForResource PipelineStatus = "waiting_for_resource"
+	StatusPreparing          PipelineStatus = "preparing"
+	StatusPending            PipelineStatus = "pending"
+	StatusRunning            PipelineStatus = "running"
+	StatusSuccess            PipelineStatus = "success"
+	StatusFailed             PipelineStatus = "failed"
+	StatusCancelled          PipelineStatus = "cancelled"
+	StatusSkipped            PipelineStatus = "skipped"
+	StatusManual             PipelineStatus = "manual"
+	StatusScheduled          PipelineStatus = "scheduled"
+	StatusOther              PipelineStatus = "other"
 )
 
+// Statuses lists every known status, in GitLab's lifecycle order.
+var Statuses = []PipelineStatus{
+	StatusCreated, StatusWaitingForResource, StatusPreparing, StatusPending,
+	StatusRunning, StatusSuccess, StatusFailed, StatusCancelled,
+	StatusSkipped, StatusManual, StatusScheduled, StatusOther,
+}
+
+// ParseStatus maps a GitLab or config status name to a PipelineStatus.
+// GitLab's "canceled" spelling is accepted; unknown names yield false.
+func ParseStatus(s string) (PipelineStatus, bool) {
+	if s == "canceled" {
+		return StatusCancelled, true
+	}
+	for _, st := range Statuses {
+		if string(st) == s {
+			return st, true
+		}
+	}
+	return StatusOther, false
+}
+
+// Event is a pipeline transition that can notify: entering a status, or
+// one of the failure transitions below.
+type Event string
+
+const (
+	// EventFailed is a failure after a success or at first sight.
+	EventFailed Event = "failed"
+	// EventStillFailing is a failure after a failure.
+	EventStillFailing Event = "still_failing"
+	// EventRecovered is a success after a failure.
+	EventRecovered Event = "recovered"
+	// EventDigest sums up what was held back during quiet hours.
+	EventDigest Event = "digest"
+)
+
+// ParseEvent accepts the failure transitions and any status name.
+func ParseEvent(s string) (Event, bool) {
+	switch e := Event(s); e {
+	case EventStillFailing, EventRecovered:
+		return e, true
+	}
+	st, ok := ParseStatus(s)
+	return Event(st), ok
+}
+
+// Severity orders statuses from best (0) to worst for aggregation.
+func (s PipelineStatus) Severity() int {
+	switch s {
+	case StatusSuccess:
+		return 0
+	case StatusSkipped, StatusManual, StatusOther:
+		return 1
+	case StatusFailed:
+		return 4
+	case StatusCancelled:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// Active reports whether a pipeline in this status may still change.
+func (s PipelineStatus) Active() bool {
+	switch s {
+	case StatusCreated, StatusWaitingForResource, StatusPreparing,
+		StatusPending, StatusRunning, StatusScheduled:
+		return true
+	default:
+		return false
+	}
+}
+
+// Worst returns the most severe status, or StatusOther if none given.
+func Worst(ss ...PipelineStatus) PipelineStatus {
+	if len(ss) == 0 {
+		return StatusOther
+	}
+	w := ss[0]
+	for _, s := range ss[1:] {
+		if s.Severity() > w.Severity() {
+			w = s
+		}
+	}
+	return w
+}
+
 type Pipeline struct {
 	ID     int64
 	Ref    string
 	Status PipelineStatus
 	WebURL string
+
+	SHA            string
+	CommitTitle    string
+	Author         string
+	AuthorUsername string
+	CreatedAt      time.Time
+	StartedAt      time.Time
+	FinishedAt     time.Time
+	Duration       time.Duration
+
+	// FailedJobs is only filled for failed pipelines.
+	FailedJobs []Job
+}
+
+type Job struct {
+	ID            int64
+	Name          string
+	Stage         string
+	FailureReason string
+	WebURL        string
+}
+
+// Severity is how urgently a notification asks for attention.
+type Severity string
+
+const (
+	SeverityLow      Severity = "low"
+	SeverityNormal   Severity = "normal"
+	SeverityCritical Severity = "critical"
+)
+
+// NotificationStyle is how notifications of one status are presented.
+type NotificationStyle struct {
+	Severity Severity
+	// Expire closes the popup after this long; zero leaves it to the
+	// notification server.
+	Expire time.Duration
+	// Sticky keeps the popup until it is dismissed, overriding Expire.
+	Sticky bool
+	// Silent asks the server for no sound and no history entry.
+	Silent bool
+	Icon   string
+}
+
+// Notification reports a pipeline status change.
+type Notification struct {
+	Title   string
+	Body    string
+	URL     string
+	Project string
+	Status  PipelineStatus
+	Event   Event
+	// Category is a freedesktop notification category.
+	Category string
+	// Retryable offers a Retry action where the backend supports one.
+	Retryable bool
+	// Pipeline is the pipeline reported; zero for a digest.
+	Pipeline Pipeline
+
+	NotificationStyle
+}
+
+// QuietWindow is a daily span on some weekdays. From and To are offsets
+// from midnight; To before From wraps past midnight and equal means all
+// day. Days are those of the moment checked, all when empty.
+type QuietWindow struct {
+	Days []time.Weekday
+	From time.Duration
+	To   time.Duration
+}
+
+func (w QuietWindow) covers(day time.Weekday, at time.Duration) bool {
+	if len(w.Days) > 0 && !slices.Contains(w.Days, day) {
+		return false
+	}
+	switch {
+	case w.From == w.To:
+		return true
+	case w.From < w.To:
+		return at >= w.From && at < w.To
+	default:
+		return at >= w.From || at < w.To
+	}
+}
+
+// QuietHours are windows in which pipelines are polled but not notified.
+type QuietHours struct {
+	Windows []QuietWindow
+	// Location defaults to local time.
+	Location *time.Location
+	// Digest summarizes what was held back once quiet hours end.
+	Digest bool
+}
+
+// Active reports whether t falls into one of the windows.
+func (q QuietHours) Active(t time.Time) bool {
+	if q.Location != nil {
+		t = t.In(q.Location)
+	}
+	at := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, w := range q.Windows {
+		if w.covers(t.Weekday(), at) {
+			return true
+		}
+	}
+	return false
+}
+
+// Me stands for the token owner in a UserFilter.
+const Me = "@me"
+
+// UserFilter restricts pipelines to those triggered by the listed
+// comma-separated usernames; Me is the token owner. Empty means everyone.
+// It is a string so ProjectRef stays usable as a map key.
+type UserFilter string
+
+func NewUserFilter(names []string) UserFilter {
+	return UserFilter(strings.Join(names, ","))
+}
+
+func (f UserFilter) Names() []string {
+	var out []string
+	for _, n := range strings.Split(string(f), ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// IsRefPattern reports whether ref is a glob rather than a single ref.
+func IsRefPattern(ref string) bool {
+	return strings.ContainsAny(ref, "*?")
+}
+
+// RefPatternPrefix returns the literal part of pattern before its first
+// wildcard.
+func RefPatternPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// MatchRef matches ref against a glob where "*" matches any run of
+// characters, including "/", and "?" matches exactly one.
+func MatchRef(pattern, ref string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(ref); i >= 0; i-- {
+				if MatchRef(pattern[1:], ref[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if ref == "" {
+				return false
+			}
+			_, n := utf8.DecodeRuneInString(ref)
+			pattern, ref = pattern[1:], ref[n:]
+		default:
+			if ref == "" || pattern[0] != ref[0] {
+				return false
+			}
+			pattern, ref = pattern[1:], ref[1:]
+		}
+	}
+	return ref == ""
 }
 
 type ProjectRef struct {
+	// Instance names the GitLab instance hosting the project; "" is the
+	// default one.
+	Instance  string
 	ProjectID int64
-	Ref       string
+	// Path is the project's full path ("group/sub/repo"), resolved to an
+	// ID by the client when ProjectID is zero.
+	Path  string
+	Ref   string
+	Name  string
+	Users UserFilter
+	// MergeRequest is the IID of a watched merge request; its pipelines
+	// are polled instead of the Ref branch's.
+	MergeRequest int64
+	// Tag watches the newest tag pipeline whose tag matches Ref, a glob;
+	// an empty Ref matches any tag.
+	Tag bool
+}
+
+// Label names pr for humans: its path, else its name.
+func (pr ProjectRef) Label() string {
+	if pr.Path != "" {
+		return pr.Path
+	}
+	return pr.Name
+}
+
+// MatchesPipeline reports whether a pipeline built on ref belongs to pr.
+func (pr ProjectRef) MatchesPipeline(ref string) bool {
+	if !pr.Tag || pr.Ref == "" {
+		return true
+	}
+	return MatchRef(pr.Ref, ref)
+}
+
+// Covers reports whether pr is other, or the glob ref other was expanded
+// from.
+func (pr ProjectRef) Covers(other ProjectRef) bool {
+	if pr == other {
+		return true
+	}
+	return IsRefPattern(pr.Ref) && !pr.Tag && !other.Tag && pr.Ref != other.Ref &&
+		pr.Instance == other.Instance && pr.ProjectID == other.ProjectID && pr.Path == other.Path && pr.Users == other.Users &&
+		pr.MergeRequest == 0 && other.MergeRequest == 0 &&
+		MatchRef(pr.Ref, other.Ref)
 }
 
 type Snapshot struct {
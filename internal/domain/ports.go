@@ -1,15 +1,39 @@
 package domain
 
-import "context"
+import (
+	"context"
+	"errors"
+)
 
 type GitlabClient interface {
 	LatestPipeline(ctx context.Context, ref ProjectRef) (Pipeline, error)
 }
 
+// ErrForeignPipeline is returned by a PipelineRetrier for a pipeline URL on
+// another GitLab instance.
+var ErrForeignPipeline = errors.New("pipeline is not on this gitlab instance")
+
+// PipelineRetrier retries the failed jobs of the pipeline at webURL.
+type PipelineRetrier interface {
+	RetryPipeline(ctx context.Context, webURL string) error
+}
+
+// RefSource discovers refs to watch at runtime, e.g. open merge requests.
+type RefSource interface {
+	Refs(ctx context.Context) ([]ProjectRef, error)
+}
+
+type RefSourceFunc func(ctx context.Context) ([]ProjectRef, error)
+
+func (f RefSourceFunc) Refs(ctx context.Context) ([]ProjectRef, error) { return f(ctx) }
+
 type Notifier interface {
-	Notify(ctx context.Context, title, body, url string) error
+	Notify(ctx context.Context, n Notification) error
 }
 
+// StatusCache keeps the latest snapshot of every watched project.
+// Write upserts a single project; Retain drops projects not in refs.
 type StatusCache interface {
 	Write(ctx context.Context, s Snapshot) error
+	Retain(ctx context.Context, refs []ProjectRef) error
 }
@@ -6,49 +6,328 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/davarch/ci-watcher/internal/domain"
 )
 
+// SchemaVersion is bumped whenever the layout of the cache file changes.
+const SchemaVersion = 2
+
 type FSCache struct {
 	path string
+
+	mu      sync.Mutex
+	loaded  bool
+	entries map[string]domain.Snapshot
+}
+
+func New(path string) *FSCache {
+	return &FSCache{path: path, entries: make(map[string]domain.Snapshot)}
+}
+
+type File struct {
+	Version  int              `json:"version"`
+	Updated  int64            `json:"updated"`
+	Worst    string           `json:"worst"`
+	Counts   map[string]int   `json:"counts"`
+	Projects map[string]Entry `json:"projects"`
 }
 
-func New(path string) *FSCache { return &FSCache{path: path} }
+type Entry struct {
+	Name      string `json:"name"`
+	Instance  string `json:"instance,omitempty"`
+	ProjectID int64  `json:"project_id"`
+	Path      string `json:"path,omitempty"`
+	Ref       string `json:"ref"`
+	Pipeline  int64  `json:"pipeline_id"`
+	Status    string `json:"status"`
+	URL       string `json:"url"`
+	Retrieved int64  `json:"retrieved"`
+	// MergeRequest is the IID when the entry watches a merge request.
+	MergeRequest int64 `json:"merge_request,omitempty"`
+	// Tag is the tag the pipeline built when the entry watches tags; Ref
+	// is then the tag pattern.
+	Tag string `json:"tag,omitempty"`
+
+	SHA            string `json:"sha,omitempty"`
+	CommitTitle    string `json:"commit_title,omitempty"`
+	Author         string `json:"author,omitempty"`
+	AuthorUsername string `json:"author_username,omitempty"`
+	// Timestamps are unix seconds, duration is in seconds.
+	CreatedAt  int64 `json:"created_at,omitempty"`
+	StartedAt  int64 `json:"started_at,omitempty"`
+	FinishedAt int64 `json:"finished_at,omitempty"`
+	Duration   int64 `json:"duration,omitempty"`
+
+	// FailedJobs is only present for failed pipelines.
+	FailedJobs []Job `json:"failed_jobs,omitempty"`
+}
+
+type Job struct {
+	Name          string `json:"name"`
+	Stage         string `json:"stage"`
+	FailureReason string `json:"failure_reason,omitempty"`
+	URL           string `json:"url"`
+}
 
 func (c *FSCache) Write(_ context.Context, s domain.Snapshot) error {
 	if c.path == "" {
 		return errors.New("cache path is empty")
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.load()
+	c.entries[Key(s.Project)] = s
+
+	return c.flush()
+}
+
+func (c *FSCache) Retain(_ context.Context, refs []domain.ProjectRef) error {
+	if c.path == "" {
+		return errors.New("cache path is empty")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.load()
+
+	keep := make(map[string]struct{}, len(refs))
+	for _, pr := range refs {
+		keep[Key(pr)] = struct{}{}
+	}
+
+	changed := false
+	for k := range c.entries {
+		if _, ok := keep[k]; !ok {
+			delete(c.entries, k)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return c.flush()
+}
+
+// Key identifies a project entry in the cache file: "id:ref" for branches,
+// "id!iid" for merge requests and "id#pattern" for tags. Projects known only
+// by path use the path in place of the id, and projects on a named GitLab
+// instance get an "@instance" suffix.
+func Key(pr domain.ProjectRef) string {
+	id := strconv.FormatInt(pr.ProjectID, 10)
+	if pr.ProjectID == 0 && pr.Path != "" {
+		id = pr.Path
+	}
+
+	var k string
+	switch {
+	case pr.MergeRequest > 0:
+		k = id + "!" + strconv.FormatInt(pr.MergeRequest, 10)
+	case pr.Tag:
+		k = id + "#" + pr.Ref
+	default:
+		k = id + ":" + pr.Ref
+	}
+	if pr.Instance != "" {
+		k += "@" + pr.Instance
+	}
+	return k
+}
+
+// WorstURL returns the pipeline URL of a project in the worst status, the
+// most recently retrieved one on ties; empty when none has a URL.
+func (f File) WorstURL() string {
+	var best Entry
+	for _, e := range f.Projects {
+		if e.Status != f.Worst || e.URL == "" {
+			continue
+		}
+		if best.URL == "" || e.Retrieved > best.Retrieved || (e.Retrieved == best.Retrieved && e.URL < best.URL) {
+			best = e
+		}
+	}
+	return best.URL
+}
+
+// Read decodes a cache file written by FSCache.
+func Read(path string) (File, error) {
+	var f File
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return f, err
+	}
+	if f.Version != SchemaVersion {
+		return f, errors.New("unsupported cache version " + strconv.Itoa(f.Version))
+	}
+
+	return f, nil
+}
+
+// load seeds entries from an existing file once, so a restart keeps the
+// last known state of every project until it is polled again.
+func (c *FSCache) load() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+
+	f, err := Read(c.path)
+	if err != nil {
+		return
+	}
+
+	for k, e := range f.Projects {
+		c.entries[k] = domain.Snapshot{
+			Project: domain.ProjectRef{Instance: e.Instance, ProjectID: e.ProjectID, Path: e.Path, Ref: e.Ref, Name: e.Name, MergeRequest: e.MergeRequest, Tag: e.Tag != ""},
+			Pipeline: domain.Pipeline{
+				ID:         e.Pipeline,
+				Ref:        pipelineRef(e),
+				Status:     domain.PipelineStatus(e.Status),
+				WebURL:     e.URL,
+				FailedJobs: fromJobs(e.FailedJobs),
+
+				SHA:            e.SHA,
+				CommitTitle:    e.CommitTitle,
+				Author:         e.Author,
+				AuthorUsername: e.AuthorUsername,
+				CreatedAt:      fromUnix(e.CreatedAt),
+				StartedAt:      fromUnix(e.StartedAt),
+				FinishedAt:     fromUnix(e.FinishedAt),
+				Duration:       time.Duration(e.Duration) * time.Second,
+			},
+			Retrieved: e.Retrieved,
+		}
+	}
+}
+
+func (c *FSCache) flush() error {
 	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
 		return err
 	}
 
-	f, err := os.Create(c.path)
+	out := File{
+		Version:  SchemaVersion,
+		Updated:  time.Now().Unix(),
+		Counts:   make(map[string]int),
+		Projects: make(map[string]Entry, len(c.entries)),
+	}
+
+	keys := make([]string, 0, len(c.entries))
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	statuses := make([]domain.PipelineStatus, 0, len(keys))
+	for _, k := range keys {
+		s := c.entries[k]
+		out.Projects[k] = Entry{
+			Name:         s.Project.Name,
+			Instance:     s.Project.Instance,
+			ProjectID:    s.Project.ProjectID,
+			Path:         s.Project.Path,
+			Ref:          refOf(s),
+			Pipeline:     s.Pipeline.ID,
+			Status:       string(s.Pipeline.Status),
+			URL:          s.Pipeline.WebURL,
+			Retrieved:    s.Retrieved,
+			MergeRequest: s.Project.MergeRequest,
+			Tag:          tagOf(s),
+			FailedJobs:   toJobs(s.Pipeline.FailedJobs),
+
+			SHA:            s.Pipeline.SHA,
+			CommitTitle:    s.Pipeline.CommitTitle,
+			Author:         s.Pipeline.Author,
+			AuthorUsername: s.Pipeline.AuthorUsername,
+			CreatedAt:      toUnix(s.Pipeline.CreatedAt),
+			StartedAt:      toUnix(s.Pipeline.StartedAt),
+			FinishedAt:     toUnix(s.Pipeline.FinishedAt),
+			Duration:       int64(s.Pipeline.Duration / time.Second),
+		}
+		out.Counts[string(s.Pipeline.Status)]++
+		statuses = append(statuses, s.Pipeline.Status)
+	}
+	out.Worst = string(domain.Worst(statuses...))
+
+	b, err := json.MarshalIndent(out, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer func() { _ = f.Close() }()
 
-	type out struct {
-		ProjectID int64  `json:"project_id"`
-		Ref       string `json:"ref"`
-		Pipeline  int64  `json:"pipeline_id"`
-		Status    string `json:"status"`
-		URL       string `json:"url"`
-		Retrieved int64  `json:"retrieved"`
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.path)
+}
+
+// refOf is the watched ref, or the branch GitLab resolved an empty one to.
+func refOf(s domain.Snapshot) string {
+	if s.Project.Ref == "" && !s.Project.Tag {
+		return s.Pipeline.Ref
 	}
+	return s.Project.Ref
+}
 
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
+func tagOf(s domain.Snapshot) string {
+	if !s.Project.Tag || s.Pipeline.ID == 0 {
+		return ""
+	}
+	return s.Pipeline.Ref
+}
 
-	return enc.Encode(out{
-		ProjectID: s.Project.ProjectID,
-		Ref:       s.Project.Ref,
-		Pipeline:  s.Pipeline.ID,
-		Status:    string(s.Pipeline.Status),
-		URL:       s.Pipeline.WebURL,
-		Retrieved: s.Retrieved,
-	})
+func pipelineRef(e Entry) string {
+	if e.Tag != "" {
+		return e.Tag
+	}
+	return e.Ref
+}
+
+func toJobs(js []domain.Job) []Job {
+	if len(js) == 0 {
+		return nil
+	}
+	out := make([]Job, 0, len(js))
+	for _, j := range js {
+		out = append(out, Job{Name: j.Name, Stage: j.Stage, FailureReason: j.FailureReason, URL: j.WebURL})
+	}
+	return out
+}
+
+func fromJobs(js []Job) []domain.Job {
+	if len(js) == 0 {
+		return nil
+	}
+	out := make([]domain.Job, 0, len(js))
+	for _, j := range js {
+		out = append(out, domain.Job{Name: j.Name, Stage: j.Stage, FailureReason: j.FailureReason, WebURL: j.URL})
+	}
+	return out
+}
+
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
 }
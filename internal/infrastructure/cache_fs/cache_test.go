@@ -25,3 +25,62 @@ func TestCache_WriteCreatesFile(t *testing.T) {
 		t.Fatalf("file not created: %v", err)
 	}
 }
+
+func TestCache_KeepsEveryProjectAndWorstStatus(t *testing.T) {
+	path := t.TempDir() + "/snap.json"
+	c := New(path)
+	ctx := context.Background()
+
+	a := domain.ProjectRef{ProjectID: 1, Ref: "main", Name: "core"}
+	b := domain.ProjectRef{ProjectID: 2, Ref: "main", Name: "api"}
+	_ = c.Write(ctx, domain.Snapshot{Project: a, Pipeline: domain.Pipeline{ID: 10, Status: domain.StatusSuccess}})
+	_ = c.Write(ctx, domain.Snapshot{Project: b, Pipeline: domain.Pipeline{ID: 20, Status: domain.StatusFailed}})
+	_ = c.Write(ctx, domain.Snapshot{Project: a, Pipeline: domain.Pipeline{ID: 11, Status: domain.StatusSuccess}})
+
+	f, err := Read(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(f.Projects) != 2 {
+		t.Fatalf("expected 2 projects, got %d", len(f.Projects))
+	}
+	if f.Projects[Key(a)].Pipeline != 11 {
+		t.Errorf("expected pipeline 11 for core, got %d", f.Projects[Key(a)].Pipeline)
+	}
+	if f.Worst != string(domain.StatusFailed) {
+		t.Errorf("expected worst=failed, got %s", f.Worst)
+	}
+	if f.Counts["success"] != 1 || f.Counts["failed"] != 1 {
+		t.Errorf("unexpected counts: %v", f.Counts)
+	}
+
+	if err := c.Retain(ctx, []domain.ProjectRef{a}); err != nil {
+		t.Fatalf("retain: %v", err)
+	}
+	f, _ = Read(path)
+	if len(f.Projects) != 1 || f.Worst != string(domain.StatusSuccess) {
+		t.Errorf("retain did not drop project: %+v", f)
+	}
+
+	reopened := New(path)
+	_ = reopened.Write(ctx, domain.Snapshot{Project: b, Pipeline: domain.Pipeline{ID: 21, Status: domain.StatusRunning}})
+	f, _ = Read(path)
+	if len(f.Projects) != 2 {
+		t.Errorf("expected previous entries to survive restart, got %d", len(f.Projects))
+	}
+}
+
+func TestFile_WorstURL(t *testing.T) {
+	f := File{Worst: "failed", Projects: map[string]Entry{
+		"1:main": {Status: "success", URL: "ok", Retrieved: 30},
+		"2:main": {Status: "failed", URL: "old", Retrieved: 10},
+		"3:main": {Status: "failed", URL: "new", Retrieved: 20},
+		"4:main": {Status: "failed", Retrieved: 40},
+	}}
+	if got := f.WorstURL(); got != "new" {
+		t.Errorf("expected the latest failed pipeline, got %q", got)
+	}
+	if got := (File{Worst: "success"}).WorstURL(); got != "" {
+		t.Errorf("expected no url for an empty cache, got %q", got)
+	}
+}
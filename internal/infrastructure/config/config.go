@@ -1,8 +1,14 @@
 package config
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -10,32 +16,341 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/davarch/ci-watcher/internal/domain"
+	"github.com/davarch/ci-watcher/internal/infrastructure/keyring_secrettool"
 	"gopkg.in/yaml.v3"
 )
 
+// ErrNoToken is returned, wrapped, for an instance in use without a
+// token. Load reports it last, with the rest of the config filled in, so
+// commands that never talk to GitLab can ignore it.
+var ErrNoToken = errors.New("token is required")
+
+// tokenCommandTimeout bounds token_command, leaving room for a passphrase
+// prompt.
+const tokenCommandTimeout = time.Minute
+
 type Project struct {
-	ProjectID int64  `yaml:"project_id"`
-	Ref       string `yaml:"ref"`
-	Enabled   bool   `yaml:"enabled"`
-	Name      string `yaml:"name,omitempty"`
+	ProjectID int64 `yaml:"project_id,omitempty"`
+	// Path ("group/sub/repo") may replace ProjectID.
+	Path     string        `yaml:"path,omitempty"`
+	Ref      string        `yaml:"ref"`
+	Enabled  bool          `yaml:"enabled"`
+	Name     string        `yaml:"name,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// OnlyMine and Usernames override the poll-wide filter when set.
+	OnlyMine  *bool    `yaml:"only_mine,omitempty"`
+	Usernames []string `yaml:"usernames,omitempty"`
+	// Tags watches tag pipelines instead of a branch; Ref is then a tag
+	// glob, empty for any tag.
+	Tags bool `yaml:"tags,omitempty"`
+	// Instance names the GitLab instance hosting the project; empty is
+	// the default gitlab section.
+	Instance string `yaml:"instance,omitempty"`
+	// Notify overrides notify.events for this project.
+	Notify []string `yaml:"notify,omitempty"`
+}
+
+// GitLab is a GitLab instance to talk to. The top-level gitlab section is
+// the unnamed default; more are listed under instances.
+type GitLab struct {
+	Name    string        `yaml:"name,omitempty"`
+	BaseURL string        `yaml:"base_url"`
+	Token   string        `yaml:"token,omitempty"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// TokenFile, TokenCommand and TokenKeyring are read, in that order,
+	// when Token is empty; see ResolveToken.
+	TokenFile    string `yaml:"token_file,omitempty"`
+	TokenCommand string `yaml:"token_command,omitempty"`
+	TokenKeyring bool   `yaml:"token_keyring,omitempty"`
+
+	// fileToken is Token as written in the file, before GITLAB_TOKEN, so
+	// Save never persists a token from the environment.
+	fileToken string
+
+	// CAFile, CertFile and KeyFile are PEM files for a private CA and a
+	// client certificate.
+	CAFile             string `yaml:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+	// ProxyURL defaults to the HTTPS_PROXY/HTTP_PROXY environment.
+	ProxyURL string `yaml:"proxy_url,omitempty"`
+}
+
+// KeyringAccount is the keyring entry holding the instance's token.
+func (g GitLab) KeyringAccount() string {
+	if g.Name == "" {
+		return "default"
+	}
+	return g.Name
+}
+
+// HasToken reports whether a token is configured, without reading it.
+func (g GitLab) HasToken() bool {
+	return g.Token != "" || g.TokenFile != "" || g.TokenCommand != "" || g.TokenKeyring
+}
+
+// ResolveToken returns the instance's token: Token (or GITLAB_TOKEN for the
+// default instance), else the first line of TokenFile, else the output of
+// TokenCommand run by sh, else the system keyring.
+func (g GitLab) ResolveToken(ctx context.Context) (string, error) {
+	switch {
+	case g.Token != "":
+		return g.Token, nil
+
+	case g.TokenFile != "":
+		b, err := os.ReadFile(g.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("token_file: %w", err)
+		}
+		line, _, _ := strings.Cut(string(b), "\n")
+		if tok := strings.TrimSpace(line); tok != "" {
+			return tok, nil
+		}
+		return "", errors.New("token_file: " + g.TokenFile + " is empty")
+
+	case g.TokenCommand != "":
+		ctx, cancel := context.WithTimeout(ctx, tokenCommandTimeout)
+		defer cancel()
+
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "sh", "-c", g.TokenCommand)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("token_command: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		line, _, _ := strings.Cut(string(out), "\n")
+		if tok := strings.TrimSpace(line); tok != "" {
+			return tok, nil
+		}
+		return "", errors.New("token_command: no output")
+
+	case g.TokenKeyring:
+		tok, err := keyring_secrettool.Lookup(ctx, g.KeyringAccount())
+		if err != nil {
+			return "", fmt.Errorf("keyring: %w", err)
+		}
+		return tok, nil
+	}
+
+	return "", errors.New("no token configured")
+}
+
+func (g *GitLab) expandPaths() {
+	g.TokenFile = expandHome(g.TokenFile)
+	g.CAFile = expandHome(g.CAFile)
+	g.CertFile = expandHome(g.CertFile)
+	g.KeyFile = expandHome(g.KeyFile)
+}
+
+// Group watches the default branch of every project in a GitLab group.
+type Group struct {
+	Group string `yaml:"group"`
+	// Include and Exclude are globs matched against each project's full
+	// path and its name; empty Include matches everything.
+	Include  []string `yaml:"include,omitempty"`
+	Exclude  []string `yaml:"exclude,omitempty"`
+	Archived bool     `yaml:"archived,omitempty"`
+	Instance string   `yaml:"instance,omitempty"`
+}
+
+// Matches reports whether the project at fullPath passes g's filters.
+func (g Group) Matches(fullPath string) bool {
+	match := func(patterns []string) bool {
+		for _, p := range patterns {
+			if domain.MatchRef(p, fullPath) || domain.MatchRef(p, path.Base(fullPath)) {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(g.Include) == 0 || match(g.Include)) && !match(g.Exclude)
+}
+
+// Style overrides the presentation of one status's notifications; unset
+// fields keep the defaults.
+type Style struct {
+	// Urgency is low, normal or critical.
+	Urgency string        `yaml:"urgency,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	Sticky  *bool         `yaml:"sticky,omitempty"`
+	Silent  *bool         `yaml:"silent,omitempty"`
+	Icon    string        `yaml:"icon,omitempty"`
+}
+
+// Apply returns base with s's fields set over it. A timeout without an
+// explicit sticky makes the notification expire.
+func (s Style) Apply(base domain.NotificationStyle) domain.NotificationStyle {
+	if s.Urgency != "" {
+		base.Severity = domain.Severity(s.Urgency)
+	}
+	if s.Timeout > 0 {
+		base.Expire = s.Timeout
+		base.Sticky = false
+	}
+	if s.Sticky != nil {
+		base.Sticky = *s.Sticky
+	}
+	if s.Silent != nil {
+		base.Silent = *s.Silent
+	}
+	if s.Icon != "" {
+		base.Icon = s.Icon
+	}
+	return base
+}
+
+// Webhook is an endpoint that every notification is POSTed to.
+type Webhook struct {
+	URL string `yaml:"url"`
+	// Secret signs each body with HMAC-SHA256.
+	Secret  string            `yaml:"secret,omitempty"`
+	Timeout time.Duration     `yaml:"timeout,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// QuietHours silences notifications in its windows, in Timezone (an IANA
+// name, local time when empty).
+type QuietHours struct {
+	Timezone string        `yaml:"timezone,omitempty"`
+	Digest   bool          `yaml:"digest,omitempty"`
+	Windows  []QuietWindow `yaml:"windows,omitempty"`
+}
+
+// QuietWindow spans From to To ("HH:MM") on Days ("mon".."sun", every day
+// when empty). To before From wraps past midnight; both empty is all day.
+type QuietWindow struct {
+	Days []string `yaml:"days,omitempty"`
+	From string   `yaml:"from,omitempty"`
+	To   string   `yaml:"to,omitempty"`
+}
+
+// Parse converts q into its domain form.
+func (q QuietHours) Parse() (domain.QuietHours, error) {
+	out := domain.QuietHours{Digest: q.Digest}
+	if q.Timezone != "" {
+		loc, err := time.LoadLocation(q.Timezone)
+		if err != nil {
+			return out, fmt.Errorf("timezone: %w", err)
+		}
+		out.Location = loc
+	}
+
+	for i, w := range q.Windows {
+		var qw domain.QuietWindow
+		for _, d := range w.Days {
+			day, ok := parseWeekday(d)
+			if !ok {
+				return out, fmt.Errorf("windows[%d]: unknown day %q", i, d)
+			}
+			qw.Days = append(qw.Days, day)
+		}
+		var err error
+		if qw.From, err = parseClock(w.From); err != nil {
+			return out, fmt.Errorf("windows[%d]: from: %w", i, err)
+		}
+		if qw.To, err = parseClock(w.To); err != nil {
+			return out, fmt.Errorf("windows[%d]: to: %w", i, err)
+		}
+		if qw.To == 24*time.Hour {
+			qw.To = 0
+		}
+		out.Windows = append(out.Windows, qw)
+	}
+	return out, nil
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) < 3 {
+		return 0, false
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.HasPrefix(strings.ToLower(d.String()), s) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// parseClock parses "HH:MM" as an offset from midnight; "24:00" is the
+// end of the day.
+func parseClock(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
 }
 
 type Config struct {
-	GitLab struct {
-		BaseURL string        `yaml:"base_url"`
-		Token   string        `yaml:"token"`
-		Timeout time.Duration `yaml:"timeout"`
-	} `yaml:"gitlab"`
+	GitLab    GitLab   `yaml:"gitlab"`
+	Instances []GitLab `yaml:"instances,omitempty"`
 
 	Poll struct {
-		Interval  time.Duration `yaml:"interval"`
-		Projects  []Project     `yaml:"projects"`
-		PauseFile string        `yaml:"pause_file"`
+		Interval    time.Duration `yaml:"interval"`
+		Concurrency int           `yaml:"concurrency"`
+		Projects    []Project     `yaml:"projects"`
+		Groups      []Group       `yaml:"groups,omitempty"`
+		PauseFile   string        `yaml:"pause_file"`
+		OnlyMine    bool          `yaml:"only_mine,omitempty"`
+		Usernames   []string      `yaml:"usernames,omitempty"`
+		// DiscoverInterval is how often dynamic targets are re-resolved.
+		DiscoverInterval time.Duration `yaml:"discover_interval,omitempty"`
+		MergeRequests    struct {
+			Enabled bool `yaml:"enabled"`
+			// Scopes are GitLab merge request scopes, by default
+			// created_by_me and assigned_to_me.
+			Scopes []string `yaml:"scopes,omitempty"`
+		} `yaml:"merge_requests,omitempty"`
+		Adaptive struct {
+			Enabled bool          `yaml:"enabled"`
+			Active  time.Duration `yaml:"active,omitempty"`
+			Idle    time.Duration `yaml:"idle,omitempty"`
+		} `yaml:"adaptive,omitempty"`
 	} `yaml:"poll"`
 
 	Cache struct {
 		Path string `yaml:"path"`
 	} `yaml:"cache"`
+
+	Notify struct {
+		// Events lists transitions that notify: statuses, recovered and
+		// still_failing; empty means all.
+		Events []string `yaml:"events,omitempty"`
+		// SilentStart keeps what the first poll after startup finds quiet.
+		SilentStart bool `yaml:"silent_start,omitempty"`
+		// QuietHours polls without notifying in its windows.
+		QuietHours QuietHours `yaml:"quiet_hours,omitempty"`
+		// Webhooks receive every notification as JSON as well.
+		Webhooks []Webhook `yaml:"webhooks,omitempty"`
+		// Backend is "dbus" (default, with Open/Retry actions) or
+		// "notify-send".
+		Backend string `yaml:"backend,omitempty"`
+		// Styles overrides how notifications look per status.
+		Styles map[string]Style `yaml:"styles,omitempty"`
+	} `yaml:"notify,omitempty"`
+
+	Control struct {
+		Socket string `yaml:"socket,omitempty"`
+	} `yaml:"control,omitempty"`
+
+	Waybar struct {
+		Format        string            `yaml:"format,omitempty"`
+		TooltipFormat string            `yaml:"tooltip_format,omitempty"`
+		PausedFormat  string            `yaml:"paused_format,omitempty"`
+		EmptyFormat   string            `yaml:"empty_format,omitempty"`
+		Classes       map[string]string `yaml:"classes,omitempty"`
+	} `yaml:"waybar,omitempty"`
 }
 
 func Load(path string) (Config, error) {
@@ -51,6 +366,7 @@ func Load(path string) (Config, error) {
 			_ = yaml.Unmarshal(b, &c)
 		}
 	}
+	c.GitLab.fileToken = c.GitLab.Token
 
 	if v := os.Getenv("GITLAB_BASE_URL"); v != "" {
 		c.GitLab.BaseURL = v
@@ -104,6 +420,8 @@ func Load(path string) (Config, error) {
 	}
 
 	c.Cache.Path = expandHome(c.Cache.Path)
+	c.Control.Socket = expandHome(c.Control.Socket)
+	c.Poll.PauseFile = expandHome(c.Poll.PauseFile)
 	if c.GitLab.BaseURL == "" {
 		c.GitLab.BaseURL = "https://gitlab.com"
 	}
@@ -112,23 +430,182 @@ func Load(path string) (Config, error) {
 		c.Poll.Interval = 20 * time.Second
 	}
 
+	if c.Poll.Adaptive.Enabled && c.Poll.Adaptive.Active <= 0 {
+		c.Poll.Adaptive.Active = 10 * time.Second
+	}
+
+	if c.Poll.Concurrency <= 0 {
+		c.Poll.Concurrency = 4
+	}
+
 	if c.GitLab.Timeout <= 0 {
 		c.GitLab.Timeout = 10 * time.Second
 	}
+	c.GitLab.expandPaths()
+
+	seen := make(map[string]bool)
+	for i := range c.Instances {
+		in := &c.Instances[i]
+		if in.Name == "" || seen[in.Name] {
+			return c, errors.New("instances: names must be unique and non-empty")
+		}
+		seen[in.Name] = true
+		if in.BaseURL == "" {
+			return c, errors.New("instance " + strconv.Quote(in.Name) + ": base_url is required")
+		}
+		if in.Timeout <= 0 {
+			in.Timeout = c.GitLab.Timeout
+		}
+		in.expandPaths()
+	}
 
-	if c.GitLab.Token == "" {
-		return c, errors.New("GITLAB_TOKEN is required")
+	var tokenErr error
+	if !c.GitLab.HasToken() && len(c.Instances) == 0 {
+		tokenErr = fmt.Errorf("GITLAB_TOKEN: %w", ErrNoToken)
 	}
 
-	if len(c.Poll.Projects) == 0 {
+	instances := make([]string, 0, len(c.Poll.Projects)+len(c.Poll.Groups))
+	for _, p := range c.Poll.Projects {
+		instances = append(instances, p.Instance)
+	}
+	for _, g := range c.Poll.Groups {
+		instances = append(instances, g.Instance)
+	}
+	for _, name := range instances {
+		if _, err := c.Instance(name); errors.Is(err, ErrNoToken) {
+			if tokenErr == nil {
+				tokenErr = err
+			}
+		} else if err != nil {
+			return c, err
+		}
+	}
+
+	if len(c.Poll.Projects) == 0 && len(c.Poll.Groups) == 0 && !c.Poll.MergeRequests.Enabled {
 		return c, errors.New("no projects configured (YAML or ENV)")
 	}
 
+	for _, ev := range c.Notify.Events {
+		if _, ok := domain.ParseEvent(ev); !ok {
+			return c, errors.New("notify.events: unknown event " + strconv.Quote(ev))
+		}
+	}
+	for _, p := range c.Poll.Projects {
+		for _, ev := range p.Notify {
+			if _, ok := domain.ParseEvent(ev); !ok {
+				return c, errors.New("project " + strconv.Quote(p.DisplayName()) + ": notify: unknown event " + strconv.Quote(ev))
+			}
+		}
+	}
+
+	for i, w := range c.Notify.Webhooks {
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return c, fmt.Errorf("notify.webhooks[%d]: url must be http(s), got %q", i, w.URL)
+		}
+	}
+
+	if _, err := c.Notify.QuietHours.Parse(); err != nil {
+		return c, errors.New("notify.quiet_hours: " + err.Error())
+	}
+
+	for st, style := range c.Notify.Styles {
+		if _, ok := domain.ParseStatus(st); !ok {
+			return c, errors.New("notify.styles: unknown status " + strconv.Quote(st))
+		}
+		switch style.Urgency {
+		case "", "low", "normal", "critical":
+		default:
+			return c, errors.New("notify.styles." + st + ": unknown urgency " + strconv.Quote(style.Urgency))
+		}
+	}
+
+	switch c.Notify.Backend {
+	case "", "dbus", "notify-send":
+	default:
+		return c, errors.New("notify.backend: unknown backend " + strconv.Quote(c.Notify.Backend))
+	}
+
 	if c.Poll.PauseFile == "" {
 		c.Poll.PauseFile = expandHome("~/.cache/ci_paused")
 	}
 
-	return c, nil
+	return c, tokenErr
+}
+
+// Instance returns the GitLab instance called name, "" being the default.
+func (c Config) Instance(name string) (GitLab, error) {
+	if name == "" {
+		if !c.GitLab.HasToken() {
+			return c.GitLab, fmt.Errorf("GITLAB_TOKEN: %w", ErrNoToken)
+		}
+		return c.GitLab, nil
+	}
+	for _, in := range c.Instances {
+		if in.Name == name {
+			if !in.HasToken() {
+				return in, fmt.Errorf("instance %q: %w", name, ErrNoToken)
+			}
+			return in, nil
+		}
+	}
+	return GitLab{}, errors.New("unknown gitlab instance " + strconv.Quote(name))
+}
+
+// GitLabs returns every usable instance: the default one when it has a
+// token, then the named ones.
+func (c Config) GitLabs() []GitLab {
+	var out []GitLab
+	if c.GitLab.HasToken() {
+		out = append(out, c.GitLab)
+	}
+	for _, in := range c.Instances {
+		if in.HasToken() {
+			out = append(out, in)
+		}
+	}
+	return out
+}
+
+// DisplayName is p's name, falling back to the last segment of its path.
+func (p Project) DisplayName() string {
+	if p.Name != "" || p.Path == "" {
+		return p.Name
+	}
+	return path.Base(p.Path)
+}
+
+// Usernames returns whose pipelines to report for p: domain.Me for the
+// token owner plus any listed usernames. Empty means everyone.
+func (c Config) Usernames(p Project) []string {
+	onlyMine, names := c.Poll.OnlyMine, c.Poll.Usernames
+	if p.OnlyMine != nil || p.Usernames != nil {
+		onlyMine, names = p.OnlyMine != nil && *p.OnlyMine, p.Usernames
+	}
+
+	var out []string
+	if onlyMine {
+		out = append(out, domain.Me)
+	}
+	return append(out, names...)
+}
+
+// NotifyEvents returns the transitions that notify for p, nil meaning all.
+func (c Config) NotifyEvents(p Project) []domain.Event {
+	names := c.Notify.Events
+	if p.Notify != nil {
+		names = p.Notify
+	}
+	if names == nil {
+		return nil
+	}
+
+	out := make([]domain.Event, 0, len(names))
+	for _, name := range names {
+		ev, _ := domain.ParseEvent(name)
+		out = append(out, ev)
+	}
+	return out
 }
 
 func Save(path string, c Config) error {
@@ -154,6 +631,10 @@ func Save(path string, c Config) error {
 		defer func() { _ = syscall.Flock(int(lf.Fd()), syscall.LOCK_UN) }()
 	}
 
+	// Tokens from GITLAB_TOKEN, files, commands or the keyring are never
+	// written back; only a token that was already in the file is.
+	c.GitLab.Token = c.GitLab.fileToken
+
 	b, err := yaml.Marshal(&c)
 	if err != nil {
 		return err
@@ -1,9 +1,15 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/domain"
 )
 
 func TestLoad_FromYAMLAndEnvOverride(t *testing.T) {
@@ -45,3 +51,265 @@ cache:
 		t.Errorf("expected 1 project, got %d", len(c.Poll.Projects))
 	}
 }
+
+func TestUsernames_ProjectOverridesGlobal(t *testing.T) {
+	var c Config
+	c.Poll.OnlyMine = true
+	c.Poll.Usernames = []string{"alice"}
+
+	if got := c.Usernames(Project{}); len(got) != 2 || got[0] != "@me" || got[1] != "alice" {
+		t.Errorf("unexpected global filter %v", got)
+	}
+
+	off := false
+	if got := c.Usernames(Project{OnlyMine: &off}); len(got) != 0 {
+		t.Errorf("expected project to disable filter, got %v", got)
+	}
+
+	if got := c.Usernames(Project{Usernames: []string{"bob"}}); len(got) != 1 || got[0] != "bob" {
+		t.Errorf("unexpected project filter %v", got)
+	}
+}
+
+func TestDisplayName_FallsBackToPath(t *testing.T) {
+	if got := (Project{Path: "team/sub/api"}).DisplayName(); got != "api" {
+		t.Errorf("expected last path segment, got %q", got)
+	}
+	if got := (Project{Name: "core", Path: "team/api"}).DisplayName(); got != "core" {
+		t.Errorf("expected explicit name, got %q", got)
+	}
+}
+
+func TestGroup_Matches(t *testing.T) {
+	g := Group{Include: []string{"svc-*", "org/team/sub/*"}, Exclude: []string{"*-legacy"}}
+
+	for path, want := range map[string]bool{
+		"org/team/svc-auth":   true,
+		"org/team/svc-legacy": false,
+		"org/team/sub/web":    true,
+		"org/team/docs":       false,
+	} {
+		if got := g.Matches(path); got != want {
+			t.Errorf("Matches(%q) = %t, want %t", path, got, want)
+		}
+	}
+
+	if !(Group{}).Matches("org/anything") {
+		t.Error("expected empty include to match everything")
+	}
+}
+
+func TestLoad_NamedInstances(t *testing.T) {
+	t.Setenv("GITLAB_TOKEN", "")
+	cfgFile := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+instances:
+  - name: corp
+    base_url: https://git.corp.example
+    token: corp-token
+poll:
+  projects:
+    - project_id: 1
+      ref: main
+      instance: corp
+      enabled: true
+`
+	if err := os.WriteFile(cfgFile, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(cfgFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	in, err := c.Instance("corp")
+	if err != nil || in.BaseURL != "https://git.corp.example" || in.Timeout != 10*time.Second {
+		t.Errorf("unexpected instance %+v (%v)", in, err)
+	}
+	if got := c.GitLabs(); len(got) != 1 || got[0].Name != "corp" {
+		t.Errorf("expected only the corp instance to be usable, got %+v", got)
+	}
+
+	bad := yaml + `    - project_id: 2
+      ref: main
+      enabled: true
+`
+	if err := os.WriteFile(cfgFile, []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(cfgFile); err == nil {
+		t.Error("expected error for a project on the default instance without a token")
+	}
+}
+
+func TestResolveToken_FileAndCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if tok, err := (GitLab{TokenFile: file}).ResolveToken(context.Background()); err != nil || tok != "from-file" {
+		t.Errorf("unexpected token_file result %q (%v)", tok, err)
+	}
+	if tok, err := (GitLab{TokenCommand: "echo from-command"}).ResolveToken(context.Background()); err != nil || tok != "from-command" {
+		t.Errorf("unexpected token_command result %q (%v)", tok, err)
+	}
+	if _, err := (GitLab{TokenCommand: "exit 3"}).ResolveToken(context.Background()); err == nil {
+		t.Error("expected failing token_command to error")
+	}
+	if tok, _ := (GitLab{Token: "inline", TokenFile: file}).ResolveToken(context.Background()); tok != "inline" {
+		t.Errorf("expected inline token to win, got %q", tok)
+	}
+}
+
+func TestSave_DoesNotWriteResolvedTokens(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+gitlab:
+  token_command: pass show gitlab
+poll:
+  projects:
+    - project_id: 1
+      ref: main
+      enabled: true
+`
+	if err := os.WriteFile(cfgFile, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GITLAB_TOKEN", "secret-env")
+
+	c, err := Load(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Poll.Projects[0].Enabled = false
+	if err := Save(cfgFile, c); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := os.ReadFile(cfgFile)
+	if strings.Contains(string(b), "secret-env") || strings.Contains(string(b), "token:") {
+		t.Errorf("token written to config:\n%s", b)
+	}
+	if !strings.Contains(string(b), "token_command: pass show gitlab") {
+		t.Errorf("token_command lost:\n%s", b)
+	}
+}
+
+func TestStyle_Apply(t *testing.T) {
+	base := domain.NotificationStyle{Severity: domain.SeverityCritical, Sticky: true, Icon: "dialog-error"}
+
+	got := Style{Timeout: 30 * time.Second}.Apply(base)
+	if got.Sticky || got.Expire != 30*time.Second || got.Severity != domain.SeverityCritical {
+		t.Errorf("expected timeout to make the popup expire, got %+v", got)
+	}
+
+	on := true
+	got = Style{Urgency: "low", Timeout: time.Second, Sticky: &on, Icon: "x"}.Apply(base)
+	if !got.Sticky || got.Severity != domain.SeverityLow || got.Icon != "x" {
+		t.Errorf("unexpected style %+v", got)
+	}
+}
+
+func TestNotifyEvents(t *testing.T) {
+	var c Config
+	if got := c.NotifyEvents(Project{}); got != nil {
+		t.Errorf("expected every event without notify.events, got %v", got)
+	}
+
+	c.Notify.Events = []string{"recovered", "canceled"}
+	if got := c.NotifyEvents(Project{}); len(got) != 2 || got[0] != domain.EventRecovered || got[1] != domain.Event(domain.StatusCancelled) {
+		t.Errorf("unexpected events %v", got)
+	}
+	if got := c.NotifyEvents(Project{Notify: []string{"still_failing"}}); len(got) != 1 || got[0] != domain.EventStillFailing {
+		t.Errorf("expected project override, got %v", got)
+	}
+}
+
+func TestQuietHours_Parse(t *testing.T) {
+	q, err := QuietHours{
+		Timezone: "UTC",
+		Windows: []QuietWindow{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "19:00", To: "08:00"},
+			{Days: []string{"Saturday", "sun"}},
+		},
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for at, want := range map[string]bool{
+		"2026-10-12T07:59:00Z": true,  // Monday morning
+		"2026-10-12T08:00:00Z": false, // Monday, work starts
+		"2026-10-16T18:59:00Z": false, // Friday evening
+		"2026-10-16T19:00:00Z": true,
+		"2026-10-17T12:00:00Z": true, // Saturday
+		"2026-10-18T23:59:00Z": true, // Sunday night
+	} {
+		tm, _ := time.Parse(time.RFC3339, at)
+		if got := q.Active(tm); got != want {
+			t.Errorf("Active(%s) = %t, want %t", at, got, want)
+		}
+	}
+
+	for _, bad := range []QuietHours{
+		{Timezone: "Nowhere/Special"},
+		{Windows: []QuietWindow{{Days: []string{"mo"}}}},
+		{Windows: []QuietWindow{{From: "7pm"}}},
+	} {
+		if _, err := bad.Parse(); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestLoad_MissingTokenIsReportedLast(t *testing.T) {
+	t.Setenv("GITLAB_TOKEN", "")
+	cfgFile := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+poll:
+  projects:
+    - project_id: 1
+      ref: main
+      enabled: true
+cache:
+  path: /tmp/ci.json
+`
+	if err := os.WriteFile(cfgFile, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(cfgFile)
+	if !errors.Is(err, ErrNoToken) {
+		t.Fatalf("expected ErrNoToken, got %v", err)
+	}
+	if c.Cache.Path != "/tmp/ci.json" || c.Poll.PauseFile == "" {
+		t.Errorf("expected the rest of the config to be loaded, got %+v", c)
+	}
+}
+
+func TestLoad_ExpandsPauseFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("GITLAB_TOKEN", "t")
+	cfgFile := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+poll:
+  pause_file: ~/.cache/ci_paused
+  projects:
+    - project_id: 1
+      ref: main
+      enabled: true
+`
+	if err := os.WriteFile(cfgFile, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(cfgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(home, ".cache/ci_paused"); c.Poll.PauseFile != want {
+		t.Errorf("expected %s, got %s", want, c.Poll.PauseFile)
+	}
+}
@@ -0,0 +1,159 @@
+package control_unix
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Protocol: one JSON Request per line, answered by one JSON Response line.
+const (
+	CmdPause  = "pause"
+	CmdResume = "resume"
+	CmdToggle = "toggle"
+	CmdPoll   = "poll"
+	CmdStatus = "status"
+	CmdReload = "reload"
+)
+
+type Request struct {
+	Cmd     string `json:"cmd"`
+	Project string `json:"project,omitempty"`
+}
+
+type Response struct {
+	OK     bool            `json:"ok"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// Handler executes control commands. Result is marshalled into
+// Response.Result when non-nil.
+type Handler interface {
+	Handle(ctx context.Context, req Request) (result any, err error)
+}
+
+type HandlerFunc func(ctx context.Context, req Request) (any, error)
+
+func (f HandlerFunc) Handle(ctx context.Context, req Request) (any, error) { return f(ctx, req) }
+
+// DefaultPath returns $XDG_RUNTIME_DIR/ci-watcher.sock, falling back to a
+// per-user file in the temp dir.
+func DefaultPath() string {
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d != "" {
+		return filepath.Join(d, "ci-watcher.sock")
+	}
+	return filepath.Join(os.TempDir(), "ci-watcher-"+strconv.Itoa(os.Getuid())+".sock")
+}
+
+type Server struct {
+	path string
+	h    Handler
+}
+
+func NewServer(path string, h Handler) *Server { return &Server{path: path, h: h} }
+
+// Serve listens until ctx is cancelled and removes the socket on return.
+func (s *Server) Serve(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+
+	if c, err := net.Dial("unix", s.path); err == nil {
+		_ = c.Close()
+		return fmt.Errorf("control socket %s is in use", s.path)
+	}
+	_ = os.Remove(s.path)
+
+	l, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(s.path) }()
+
+	if err := os.Chmod(s.path, 0o600); err != nil {
+		_ = l.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	sc := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for sc.Scan() {
+		var (
+			req  Request
+			resp Response
+		)
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			resp.Error = "bad request: " + err.Error()
+		} else if res, err := s.h.Handle(ctx, req); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.OK = true
+			if res != nil {
+				if resp.Result, err = json.Marshal(res); err != nil {
+					resp.OK, resp.Error = false, err.Error()
+				}
+			}
+		}
+
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// Call sends a single request to the daemon listening on path.
+func Call(ctx context.Context, path string, req Request) (Response, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return Response{}, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return Response{}, err
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return Response{}, err
+	}
+	if !resp.OK {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,84 @@
+package control_unix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_RoundTrip(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "s.sock")
+
+	var (
+		mu  sync.Mutex
+		got []Request
+	)
+	h := HandlerFunc(func(_ context.Context, req Request) (any, error) {
+		mu.Lock()
+		got = append(got, req)
+		mu.Unlock()
+		switch req.Cmd {
+		case CmdStatus:
+			return map[string]bool{"paused": true}, nil
+		case CmdPoll:
+			return nil, errors.New("unknown project")
+		}
+		return nil, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- NewServer(path, h).Serve(ctx) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("socket not created")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := Call(ctx, path, Request{Cmd: CmdPause}); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+
+	resp, err := Call(ctx, path, Request{Cmd: CmdStatus})
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	var st map[string]bool
+	if err := json.Unmarshal(resp.Result, &st); err != nil || !st["paused"] {
+		t.Errorf("unexpected status result %s (%v)", resp.Result, err)
+	}
+
+	if _, err := Call(ctx, path, Request{Cmd: CmdPoll, Project: "x"}); err == nil || err.Error() != "unknown project" {
+		t.Errorf("expected handler error, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 3 || got[2].Project != "x" {
+		t.Errorf("unexpected requests %+v", got)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("socket not removed on shutdown")
+	}
+}
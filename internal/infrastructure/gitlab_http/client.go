@@ -2,144 +2,544 @@ package gitlab_http
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/davarch/ci-watcher/internal/domain"
 )
 
+// defaultBranchTTL is how long a looked-up default branch is trusted, so
+// renames (e.g. master to main) are eventually followed.
+const defaultBranchTTL = time.Hour
+
+// tagPageSize is how many recent tag pipelines are searched for one whose
+// tag matches a pattern.
+const tagPageSize = 50
+
 type Client struct {
 	baseUrl string
 	token   string
 	hc      *http.Client
+
+	mu       sync.Mutex
+	me       string
+	commits  map[string]string
+	projects map[string]projectInfo
+	polled   map[domain.ProjectRef]polled
+}
+
+// polled is what the last poll of a ref saw, so that unchanged list
+// responses (304) and known pipelines need no further requests.
+type polled struct {
+	lists    map[string]listResult // by list URL
+	pipeline domain.Pipeline
+}
+
+type listResult struct {
+	etag string
+	best *pipelineDTO
+}
+
+// maxPolled bounds the per-ref poll state of refs that are no longer watched.
+const maxPolled = 1024
+
+type projectInfo struct {
+	ID            int64
+	DefaultBranch string
+	checked       time.Time
 }
 
 func New(baseUrl string, token string, timeout time.Duration) *Client {
-	tr := &http.Transport{
-		DialContext:         (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
-		TLSHandshakeTimeout: 5 * time.Second,
-		MaxIdleConns:        100,
-		IdleConnTimeout:     90 * time.Second,
+	c, _ := NewWithTransport(baseUrl, token, timeout, Transport{})
+	return c
+}
+
+// NewWithTransport is New with TLS and proxy settings. It fails when a
+// certificate file cannot be loaded.
+func NewWithTransport(baseUrl string, token string, timeout time.Duration, t Transport) (*Client, error) {
+	tr, err := t.build()
+	if err != nil {
+		return nil, err
 	}
 
 	return &Client{
-		baseUrl: trimSlash(baseUrl),
-		token:   token,
-		hc:      &http.Client{Transport: tr, Timeout: timeout},
-	}
+		baseUrl:  trimSlash(baseUrl),
+		token:    token,
+		hc:       &http.Client{Transport: tr, Timeout: timeout},
+		commits:  make(map[string]string),
+		projects: make(map[string]projectInfo),
+		polled:   make(map[domain.ProjectRef]polled),
+	}, nil
 }
 
 type pipelineDTO struct {
-	ID     int64  `json:"id"`
-	Ref    string `json:"ref"`
-	Status string `json:"status"`
-	WebURL string `json:"web_url"`
+	ID         int64      `json:"id"`
+	Ref        string     `json:"ref"`
+	Status     string     `json:"status"`
+	WebURL     string     `json:"web_url"`
+	SHA        string     `json:"sha"`
+	CreatedAt  *time.Time `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Duration   float64    `json:"duration"`
+	User       *struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"user"`
+}
+
+func (d pipelineDTO) toDomain() domain.Pipeline {
+	p := domain.Pipeline{
+		ID:       d.ID,
+		Ref:      d.Ref,
+		Status:   mapStatus(d.Status),
+		WebURL:   d.WebURL,
+		SHA:      d.SHA,
+		Duration: time.Duration(d.Duration * float64(time.Second)),
+	}
+	if d.CreatedAt != nil {
+		p.CreatedAt = *d.CreatedAt
+	}
+	if d.StartedAt != nil {
+		p.StartedAt = *d.StartedAt
+	}
+	if d.FinishedAt != nil {
+		p.FinishedAt = *d.FinishedAt
+	}
+	if d.User != nil {
+		p.Author, p.AuthorUsername = d.User.Name, d.User.Username
+	}
+	return p
 }
 
 func (c *Client) LatestPipeline(ctx context.Context, pr domain.ProjectRef) (domain.Pipeline, error) {
-	var out domain.Pipeline
+	key := pr
+
+	var err error
+	if pr, err = c.resolve(ctx, pr); err != nil {
+		return domain.Pipeline{}, err
+	}
+
+	usernames, err := c.usernames(ctx, pr.Users)
+	if err != nil {
+		return domain.Pipeline{}, err
+	}
+
+	c.mu.Lock()
+	prev, seen := c.polled[key]
+	c.mu.Unlock()
 
+	var (
+		out       domain.Pipeline
+		lists     map[string]listResult
+		unchanged bool
+	)
 	op := func() error {
-		listURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines?ref=%s&per_page=1",
-			c.baseUrl, pr.ProjectID, pr.Ref)
+		var (
+			p     pipelineDTO
+			found bool
+		)
+		lists = make(map[string]listResult)
+		unchanged = seen
+		for _, listURL := range c.pipelineListURLs(pr, usernames) {
+			old, ok := prev.lists[listURL]
 
-		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
-		req.Header.Set("PRIVATE-TOKEN", c.token)
+			var list []pipelineDTO
+			etag, notModified, err := c.getJSONIf(ctx, listURL, old.etag, &list)
+			if err != nil {
+				return err
+			}
+			res := old
+			if !ok || !notModified {
+				res, unchanged = listResult{etag: etag, best: latestMatching(pr, list)}, false
+			}
+			lists[listURL] = res
 
-		resp, err := c.hc.Do(req)
-		if err != nil {
-			return err
+			if res.best != nil && (!found || res.best.ID > p.ID) {
+				p, found = *res.best, true
+			}
 		}
 
-		defer func() { _ = resp.Body.Close() }()
-
-		if resp.StatusCode == http.StatusTooManyRequests {
-			if ra := resp.Header.Get("Retry-After"); ra != "" {
-				if sec, _ := strconv.Atoi(ra); sec > 0 {
-					select {
-					case <-time.After(time.Duration(sec) * time.Second):
-					case <-ctx.Done():
-						return ctx.Err()
-					}
-					return fmt.Errorf("retry after due to 429")
+		if unchanged {
+			out = prev.pipeline
+			return nil
+		}
+
+		if !found {
+			out = domain.Pipeline{ID: 0, Ref: pr.Ref, Status: domain.StatusOther}
+			return nil
+		}
+
+		// The list lacks author and timing, so a new pipeline, or one that
+		// just finished, still needs its detail. Otherwise those carry over.
+		known := seen && prev.pipeline.ID == p.ID
+		st := mapStatus(p.Status)
+		if p.WebURL == "" || !known || (st != prev.pipeline.Status && !st.Active()) {
+			if d, ok := c.pipelineDetail(ctx, pr.ProjectID, p.ID); ok {
+				if d.WebURL == "" {
+					d.WebURL = p.WebURL
 				}
+				p = d
 			}
+			out = p.toDomain()
+			return nil
+		}
+
+		out = p.toDomain()
+		out.Author, out.AuthorUsername = prev.pipeline.Author, prev.pipeline.AuthorUsername
+		out.CreatedAt, out.StartedAt = prev.pipeline.CreatedAt, prev.pipeline.StartedAt
+		out.FinishedAt, out.Duration = prev.pipeline.FinishedAt, prev.pipeline.Duration
+
+		return nil
+	}
 
-			return fmt.Errorf("gitlab 429")
+	if err := retry(ctx, op); err != nil {
+		return domain.Pipeline{}, err
+	}
+
+	if !unchanged {
+		if out.SHA != "" {
+			out.CommitTitle = c.commitTitle(ctx, pr.ProjectID, out.SHA)
 		}
 
-		if resp.StatusCode >= 500 {
-			return fmt.Errorf("gitlab %s", resp.Status)
+		if out.Status == domain.StatusFailed {
+			if seen && prev.pipeline.ID == out.ID && prev.pipeline.Status == out.Status {
+				out.FailedJobs = prev.pipeline.FailedJobs
+			} else {
+				// Best effort: a pipeline without job detail is still worth reporting.
+				out.FailedJobs, _ = c.failedJobs(ctx, pr.ProjectID, out.ID)
+			}
 		}
+	}
 
-		if resp.StatusCode >= 300 {
-			return backoff.Permanent(fmt.Errorf("gitlab %s", resp.Status))
+	c.mu.Lock()
+	if len(c.polled) >= maxPolled {
+		clear(c.polled)
+	}
+	c.polled[key] = polled{lists: lists, pipeline: out}
+	c.mu.Unlock()
+
+	return out, nil
+}
+
+// latestMatching returns the first pipeline of a newest-first list that
+// belongs to pr.
+func latestMatching(pr domain.ProjectRef, list []pipelineDTO) *pipelineDTO {
+	for i := range list {
+		if pr.MatchesPipeline(list[i].Ref) {
+			return &list[i]
 		}
+	}
+	return nil
+}
+
+// pipelineDetail fetches a single pipeline. It is best effort: the list
+// entry is good enough when it fails.
+func (c *Client) pipelineDetail(ctx context.Context, projectID, id int64) (pipelineDTO, bool) {
+	var d pipelineDTO
+	detailURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines/%d", c.baseUrl, projectID, id)
+	if err := c.getJSON(ctx, detailURL, &d); err != nil || d.ID != id {
+		return pipelineDTO{}, false
+	}
+	return d, true
+}
+
+// pipelineListURLs returns the list queries whose newest matching result is
+// the ref's latest pipeline: one per username, or the merge request's
+// pipelines. Tag refs list recent tag pipelines to match against the glob.
+func (c *Client) pipelineListURLs(pr domain.ProjectRef, usernames []string) []string {
+	if pr.MergeRequest > 0 {
+		return []string{fmt.Sprintf("%s/api/v4/projects/%d/merge_requests/%d/pipelines?per_page=1",
+			c.baseUrl, pr.ProjectID, pr.MergeRequest)}
+	}
 
-		var list []pipelineDTO
-		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
-			return err
+	out := make([]string, 0, len(usernames))
+	for _, u := range usernames {
+		q := url.Values{"ref": {pr.Ref}, "per_page": {"1"}}
+		if pr.Tag {
+			q = url.Values{"scope": {"tags"}, "per_page": {strconv.Itoa(tagPageSize)}}
 		}
+		if u != "" {
+			q.Set("username", u)
+		}
+		out = append(out, fmt.Sprintf("%s/api/v4/projects/%d/pipelines?%s", c.baseUrl, pr.ProjectID, q.Encode()))
+	}
+	return out
+}
 
-		if len(list) == 0 {
-			out = domain.Pipeline{ID: 0, Ref: pr.Ref, Status: domain.StatusOther}
-			return nil
+// usernames expands a user filter into the usernames to query, resolving
+// domain.Me to the token owner. No filter yields a single "" (everyone).
+func (c *Client) usernames(ctx context.Context, f domain.UserFilter) ([]string, error) {
+	names := f.Names()
+	if len(names) == 0 {
+		return []string{""}, nil
+	}
+
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		if n == domain.Me {
+			me, err := c.CurrentUser(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("resolve token owner: %w", err)
+			}
+			n = me
 		}
+		out = append(out, n)
+	}
+	return out, nil
+}
 
-		p := list[0]
+// resolve fills in what pr leaves to GitLab: the ID of a project known by
+// path, and the default branch when a branch ref is empty.
+func (c *Client) resolve(ctx context.Context, pr domain.ProjectRef) (domain.ProjectRef, error) {
+	needBranch := pr.Ref == "" && !pr.Tag && pr.MergeRequest == 0
+	if !needBranch && (pr.ProjectID != 0 || pr.Path == "") {
+		return pr, nil
+	}
 
-		detailURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines/%d", c.baseUrl, pr.ProjectID, p.ID)
-		dreg, _ := http.NewRequestWithContext(ctx, http.MethodGet, detailURL, nil)
-		dreg.Header.Set("PRIVATE-TOKEN", c.token)
+	info, err := c.project(ctx, pr, needBranch)
+	if err != nil {
+		return pr, err
+	}
 
-		dresp, derr := c.hc.Do(dreg)
-		if derr == nil && dresp.StatusCode < 300 {
-			defer func() { _ = dresp.Body.Close() }()
-			var d pipelineDTO
-			if json.NewDecoder(dresp.Body).Decode(&d) == nil && d.WebURL != "" {
-				p.WebURL = d.WebURL
-			}
+	pr.ProjectID = info.ID
+	if needBranch {
+		pr.Ref = info.DefaultBranch
+	}
+	return pr, nil
+}
+
+// project returns pr's project metadata, cached; fresh asks for a lookup
+// no older than defaultBranchTTL.
+func (c *Client) project(ctx context.Context, pr domain.ProjectRef, fresh bool) (projectInfo, error) {
+	// Paths contain slashes, which GitLab expects encoded as one segment.
+	key := strings.ReplaceAll(url.PathEscape(pr.Path), "/", "%2F")
+	if pr.ProjectID != 0 {
+		key = strconv.FormatInt(pr.ProjectID, 10)
+	}
+
+	c.mu.Lock()
+	info, ok := c.projects[key]
+	c.mu.Unlock()
+	if ok && (!fresh || time.Since(info.checked) < defaultBranchTTL) {
+		return info, nil
+	}
+
+	var p struct {
+		ID            int64  `json:"id"`
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := retry(ctx, func() error {
+		return c.getJSON(ctx, c.baseUrl+"/api/v4/projects/"+key, &p)
+	}); err != nil {
+		return projectInfo{}, fmt.Errorf("look up project %s: %w", key, err)
+	}
+	if fresh && p.DefaultBranch == "" {
+		return projectInfo{}, fmt.Errorf("project %s has no default branch", key)
+	}
+
+	info = projectInfo{ID: p.ID, DefaultBranch: p.DefaultBranch, checked: time.Now()}
+	c.mu.Lock()
+	c.projects[key] = info
+	c.mu.Unlock()
+
+	return info, nil
+}
+
+// CurrentUser returns the username of the token owner, cached after the
+// first successful lookup.
+func (c *Client) CurrentUser(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	me := c.me
+	c.mu.Unlock()
+	if me != "" {
+		return me, nil
+	}
+
+	var u struct {
+		Username string `json:"username"`
+	}
+	if err := retry(ctx, func() error {
+		return c.getJSON(ctx, c.baseUrl+"/api/v4/user", &u)
+	}); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.me = u.Username
+	c.mu.Unlock()
+
+	return u.Username, nil
+}
+
+// getJSON performs an authenticated GET and decodes the body into out.
+// Errors are shaped for retry: 4xx other than 429 are permanent.
+func (c *Client) getJSON(ctx context.Context, u string, out any) error {
+	_, _, err := c.getJSONIf(ctx, u, "", out)
+	return err
+}
+
+// getJSONIf is getJSON as a conditional request: with a non-empty etag a
+// 304 reports notModified and leaves out untouched. It returns the
+// response's ETag for the next call.
+func (c *Client) getJSONIf(ctx context.Context, u, etag string, out any) (newETag string, notModified bool, err error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		// Certificate problems will not go away by retrying: ours, or the
+		// server's TLS alert (e.g. a missing client certificate).
+		var (
+			verr *tls.CertificateVerificationError
+			oerr *net.OpError
+		)
+		if errors.As(err, &verr) || (errors.As(err, &oerr) && oerr.Op == "remote error") {
+			return "", false, backoff.Permanent(err)
 		}
+		return "", false, err
+	}
+
+	defer func() { _ = resp.Body.Close() }()
 
-		out = domain.Pipeline{
-			ID:     p.ID,
-			Ref:    p.Ref,
-			Status: mapStatus(p.Status),
-			WebURL: p.WebURL,
+	if resp.StatusCode == http.StatusNotModified && etag != "" {
+		return etag, true, nil
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if ra := resp.Header.Get("Retry-After"); ra != "" {
+			if sec, _ := strconv.Atoi(ra); sec > 0 {
+				select {
+				case <-time.After(time.Duration(sec) * time.Second):
+				case <-ctx.Done():
+					return "", false, ctx.Err()
+				}
+				return "", false, fmt.Errorf("retry after due to 429")
+			}
 		}
 
-		return nil
+		return "", false, fmt.Errorf("gitlab 429")
 	}
 
+	if resp.StatusCode >= 500 {
+		return "", false, fmt.Errorf("gitlab %s", resp.Status)
+	}
+
+	if resp.StatusCode >= 300 {
+		return "", false, backoff.Permanent(fmt.Errorf("gitlab %s", resp.Status))
+	}
+
+	return resp.Header.Get("ETag"), false, json.NewDecoder(resp.Body).Decode(out)
+}
+
+func retry(ctx context.Context, op backoff.Operation) error {
 	bo := backoff.NewExponentialBackOff()
 	bo.InitialInterval = 300 * time.Millisecond
 	bo.MaxInterval = 2 * time.Second
 	bo.MaxElapsedTime = 5 * time.Second
 
-	if err := backoff.Retry(op, backoff.WithContext(bo, ctx)); err != nil {
-		return domain.Pipeline{}, err
+	return backoff.Retry(op, backoff.WithContext(bo, ctx))
+}
+
+type jobDTO struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Stage         string `json:"stage"`
+	FailureReason string `json:"failure_reason"`
+	WebURL        string `json:"web_url"`
+	AllowFailure  bool   `json:"allow_failure"`
+}
+
+func (c *Client) failedJobs(ctx context.Context, projectID, pipelineID int64) ([]domain.Job, error) {
+	jobsURL := fmt.Sprintf("%s/api/v4/projects/%d/pipelines/%d/jobs?scope[]=failed&per_page=100",
+		c.baseUrl, projectID, pipelineID)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, jobsURL, nil)
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
 	}
-	return out, nil
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("gitlab %s", resp.Status)
+	}
+
+	var list []jobDTO
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]domain.Job, 0, len(list))
+	for _, j := range list {
+		if j.AllowFailure {
+			continue
+		}
+		jobs = append(jobs, domain.Job{
+			ID:            j.ID,
+			Name:          j.Name,
+			Stage:         j.Stage,
+			FailureReason: j.FailureReason,
+			WebURL:        j.WebURL,
+		})
+	}
+	return jobs, nil
 }
 
-func mapStatus(s string) domain.PipelineStatus {
-	switch s {
-	case "success":
-		return domain.StatusSuccess
-	case "failed":
-		return domain.StatusFailed
-	case "running":
-		return domain.StatusRunning
-	case "canceled":
-		return domain.StatusCancelled
-	default:
-		return domain.StatusOther
+// commitTitle returns the commit's title, cached by sha. Failures yield "".
+func (c *Client) commitTitle(ctx context.Context, projectID int64, sha string) string {
+	c.mu.Lock()
+	title, ok := c.commits[sha]
+	c.mu.Unlock()
+	if ok {
+		return title
 	}
+
+	commitURL := fmt.Sprintf("%s/api/v4/projects/%d/repository/commits/%s", c.baseUrl, projectID, sha)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, commitURL, nil)
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var d struct {
+		Title string `json:"title"`
+	}
+	if resp.StatusCode >= 300 || json.NewDecoder(resp.Body).Decode(&d) != nil {
+		return ""
+	}
+
+	c.mu.Lock()
+	if len(c.commits) >= 256 {
+		clear(c.commits)
+	}
+	c.commits[sha] = d.Title
+	c.mu.Unlock()
+
+	return d.Title
+}
+
+func mapStatus(s string) domain.PipelineStatus {
+	st, _ := domain.ParseStatus(s)
+	return st
 }
 
 func trimSlash(s string) string {
@@ -148,3 +548,35 @@ func trimSlash(s string) string {
 	}
 	return s
 }
+
+// RetryPipeline retries the failed jobs of the pipeline at webURL
+// (".../<project path>/-/pipelines/<id>"). The token needs the api scope.
+func (c *Client) RetryPipeline(ctx context.Context, webURL string) error {
+	rest, ok := strings.CutPrefix(webURL, c.baseUrl+"/")
+	if !ok {
+		return domain.ErrForeignPipeline
+	}
+	project, id, ok := strings.Cut(rest, "/-/pipelines/")
+	if !ok {
+		return fmt.Errorf("not a pipeline url: %s", webURL)
+	}
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return fmt.Errorf("not a pipeline url: %s", webURL)
+	}
+
+	u := fmt.Sprintf("%s/api/v4/projects/%s/pipelines/%s/retry",
+		c.baseUrl, strings.ReplaceAll(url.PathEscape(project), "/", "%2F"), id)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("gitlab %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package gitlab_http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+)
+
+func TestLatestPipeline_DetailAndFailedJobs(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/42/pipelines", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "tok" {
+			t.Errorf("missing token header")
+		}
+		_, _ = w.Write([]byte(`[{"id":7,"ref":"main","status":"failed"}]`))
+	})
+	mux.HandleFunc("/api/v4/projects/42/pipelines/7", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id":7,"ref":"main","status":"failed","web_url":"https://gl/p/7",
+			"sha":"abc123","duration":95.5,"started_at":"2026-01-02T10:00:00Z",
+			"user":{"name":"Jane Doe","username":"jane"}}`))
+	})
+	mux.HandleFunc("/api/v4/projects/42/repository/commits/abc123", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id":"abc123","title":"Fix flaky test"}`))
+	})
+	mux.HandleFunc("/api/v4/projects/42/pipelines/7/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope[]") != "failed" {
+			t.Errorf("expected failed scope, got %q", r.URL.RawQuery)
+		}
+		_, _ = w.Write([]byte(`[
+			{"id":1,"name":"unit","stage":"test","failure_reason":"script_failure","web_url":"https://gl/j/1"},
+			{"id":2,"name":"lint","stage":"test","failure_reason":"script_failure","allow_failure":true}
+		]`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL+"/", "tok", time.Second)
+	p, err := c.LatestPipeline(context.Background(), domain.ProjectRef{ProjectID: 42, Ref: "main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Status != domain.StatusFailed || p.WebURL != "https://gl/p/7" {
+		t.Errorf("unexpected pipeline %+v", p)
+	}
+	if p.SHA != "abc123" || p.CommitTitle != "Fix flaky test" || p.Author != "Jane Doe" || p.AuthorUsername != "jane" {
+		t.Errorf("unexpected commit metadata %+v", p)
+	}
+	if p.Duration != 95500*time.Millisecond || p.StartedAt.IsZero() || !p.FinishedAt.IsZero() {
+		t.Errorf("unexpected timing %s %s %s", p.Duration, p.StartedAt, p.FinishedAt)
+	}
+	if len(p.FailedJobs) != 1 || p.FailedJobs[0].Name != "unit" || p.FailedJobs[0].FailureReason != "script_failure" {
+		t.Errorf("unexpected failed jobs %+v", p.FailedJobs)
+	}
+}
+
+func TestMapStatus(t *testing.T) {
+	cases := map[string]domain.PipelineStatus{
+		"canceled":             domain.StatusCancelled,
+		"waiting_for_resource": domain.StatusWaitingForResource,
+		"manual":               domain.StatusManual,
+		"bogus":                domain.StatusOther,
+	}
+	for in, want := range cases {
+		if got := mapStatus(in); got != want {
+			t.Errorf("mapStatus(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestLatestPipeline_UserFilter(t *testing.T) {
+	var userCalls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		userCalls++
+		_, _ = w.Write([]byte(`{"username":"me"}`))
+	})
+	mux.HandleFunc("/api/v4/projects/42/pipelines", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("ref") != "release/1.0" {
+			t.Errorf("unexpected ref %q", r.URL.Query().Get("ref"))
+		}
+		switch r.URL.Query().Get("username") {
+		case "me":
+			_, _ = w.Write([]byte(`[{"id":5,"ref":"release/1.0","status":"success"}]`))
+		case "bob":
+			_, _ = w.Write([]byte(`[{"id":9,"ref":"release/1.0","status":"failed"}]`))
+		default:
+			t.Errorf("expected a username filter, got %q", r.URL.RawQuery)
+			_, _ = w.Write([]byte(`[]`))
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL, "tok", time.Second)
+	pr := domain.ProjectRef{ProjectID: 42, Ref: "release/1.0", Users: domain.NewUserFilter([]string{domain.Me, "bob"})}
+
+	for i := 0; i < 2; i++ {
+		p, err := c.LatestPipeline(context.Background(), pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.ID != 9 {
+			t.Errorf("expected newest pipeline across users (9), got %d", p.ID)
+		}
+	}
+	if userCalls != 1 {
+		t.Errorf("expected token owner to be resolved once, got %d", userCalls)
+	}
+}
+
+func TestOpenMergeRequestsAndPipelines(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/merge_requests", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != "opened" {
+			t.Errorf("expected opened state, got %q", r.URL.RawQuery)
+		}
+		switch r.URL.Query().Get("scope") {
+		case "created_by_me":
+			_, _ = w.Write([]byte(`[{"iid":3,"project_id":42,"source_branch":"feat","references":{"full":"g/p!3"}}]`))
+		case "assigned_to_me":
+			_, _ = w.Write([]byte(`[{"iid":3,"project_id":42,"source_branch":"feat","references":{"full":"g/p!3"}},
+				{"iid":8,"project_id":43,"source_branch":"fix","references":{"full":"g/q!8"}}]`))
+		}
+	})
+	mux.HandleFunc("/api/v4/projects/42/merge_requests/3/pipelines", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"id":11,"ref":"refs/merge-requests/3/head","status":"running"}]`))
+	})
+	mux.HandleFunc("/api/v4/projects/42/pipelines/11", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id":11,"ref":"refs/merge-requests/3/head","status":"running","web_url":"u"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL, "tok", time.Second)
+	refs, err := c.OpenMergeRequests(context.Background(), []string{"created_by_me", "assigned_to_me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || refs[0].MergeRequest != 3 || refs[0].Name != "g/p!3" || refs[1].ProjectID != 43 {
+		t.Fatalf("unexpected refs %+v", refs)
+	}
+
+	p, err := c.LatestPipeline(context.Background(), refs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != 11 || p.Status != domain.StatusRunning {
+		t.Errorf("unexpected merge request pipeline %+v", p)
+	}
+}
+
+func TestLatestPipeline_TagPattern(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/42/pipelines", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "tags" || r.URL.Query().Has("ref") {
+			t.Errorf("expected tag scope without ref, got %q", r.URL.RawQuery)
+		}
+		_, _ = w.Write([]byte(`[{"id":30,"ref":"nightly-7","status":"success"},
+			{"id":29,"ref":"v2.1.0","status":"running"},
+			{"id":20,"ref":"v2.0.0","status":"success"}]`))
+	})
+	mux.HandleFunc("/api/v4/projects/42/pipelines/", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL, "tok", time.Second)
+	p, err := c.LatestPipeline(context.Background(), domain.ProjectRef{ProjectID: 42, Ref: "v*", Tag: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != 29 || p.Ref != "v2.1.0" || p.Status != domain.StatusRunning {
+		t.Errorf("unexpected tag pipeline %+v", p)
+	}
+
+	p, _ = c.LatestPipeline(context.Background(), domain.ProjectRef{ProjectID: 42, Tag: true})
+	if p.ID != 30 {
+		t.Errorf("expected newest tag pipeline for an empty pattern, got %+v", p)
+	}
+}
+
+func TestLatestPipeline_ResolvesPathOnce(t *testing.T) {
+	lookups := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v4/projects/team%2Fsub%2Fapi":
+			lookups++
+			_, _ = w.Write([]byte(`{"id":42,"path_with_namespace":"team/sub/api"}`))
+		case "/api/v4/projects/42/pipelines":
+			_, _ = w.Write([]byte(`[{"id":7,"ref":"main","status":"success","web_url":"u"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL, "tok", time.Second)
+	pr := domain.ProjectRef{Path: "team/sub/api", Ref: "main"}
+	for i := 0; i < 2; i++ {
+		p, err := c.LatestPipeline(context.Background(), pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.ID != 7 {
+			t.Errorf("unexpected pipeline %+v", p)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected path resolved once, got %d lookups", lookups)
+	}
+}
+
+func TestLatestPipeline_DefaultBranch(t *testing.T) {
+	var (
+		lookups int
+		branch  = "master"
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/42", func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		_, _ = w.Write([]byte(`{"id":42,"default_branch":"` + branch + `"}`))
+	})
+	mux.HandleFunc("/api/v4/projects/42/pipelines", func(w http.ResponseWriter, r *http.Request) {
+		ref := r.URL.Query().Get("ref")
+		_, _ = w.Write([]byte(`[{"id":7,"ref":"` + ref + `","status":"success","web_url":"u"}]`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL, "tok", time.Second)
+	pr := domain.ProjectRef{ProjectID: 42}
+
+	for i := 0; i < 2; i++ {
+		if p, _ := c.LatestPipeline(context.Background(), pr); p.Ref != "master" {
+			t.Fatalf("expected default branch master, got %+v", p)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("expected one project lookup, got %d", lookups)
+	}
+
+	branch = "main"
+	c.mu.Lock()
+	info := c.projects["42"]
+	info.checked = info.checked.Add(-defaultBranchTTL)
+	c.projects["42"] = info
+	c.mu.Unlock()
+
+	if p, _ := c.LatestPipeline(context.Background(), pr); p.Ref != "main" {
+		t.Errorf("expected renamed default branch to be followed, got %+v", p)
+	}
+}
+
+func TestLatestPipeline_ETagSkipsUnchanged(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests = make(map[string]int)
+		status   = "running"
+	)
+	count := func(r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/42/pipelines", func(w http.ResponseWriter, r *http.Request) {
+		count(r)
+		etag := `W/"` + status + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(`[{"id":7,"ref":"main","status":"` + status + `","web_url":"https://gl/p/7"}]`))
+	})
+	mux.HandleFunc("/api/v4/projects/42/pipelines/7", func(w http.ResponseWriter, r *http.Request) {
+		count(r)
+		_, _ = w.Write([]byte(`{"id":7,"ref":"main","status":"` + status + `","web_url":"https://gl/p/7",
+			"duration":60,"user":{"name":"Jane Doe","username":"jane"}}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL, "tok", time.Second)
+	pr := domain.ProjectRef{ProjectID: 42, Ref: "main"}
+	poll := func() domain.Pipeline {
+		t.Helper()
+		p, err := c.LatestPipeline(context.Background(), pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	take := func() (list, detail int) {
+		mu.Lock()
+		defer mu.Unlock()
+		list, detail = requests["/api/v4/projects/42/pipelines"], requests["/api/v4/projects/42/pipelines/7"]
+		clear(requests)
+		return list, detail
+	}
+
+	poll()
+	if list, detail := take(); list != 1 || detail != 1 {
+		t.Fatalf("first poll: expected list and detail, got %d/%d", list, detail)
+	}
+
+	for i := 0; i < 3; i++ {
+		if p := poll(); p.Status != domain.StatusRunning || p.Author != "Jane Doe" {
+			t.Fatalf("unexpected cached pipeline %+v", p)
+		}
+	}
+	if list, detail := take(); list != 3 || detail != 0 {
+		t.Errorf("unchanged polls: expected 3 conditional lists and no detail, got %d/%d", list, detail)
+	}
+
+	status = "success"
+	if p := poll(); p.Status != domain.StatusSuccess || p.Duration != time.Minute {
+		t.Errorf("unexpected finished pipeline %+v", p)
+	}
+	if list, detail := take(); list != 1 || detail != 1 {
+		t.Errorf("finished pipeline: expected list and detail, got %d/%d", list, detail)
+	}
+}
+
+func TestRetryPipeline(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Method + " " + r.URL.EscapedPath()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, "tok", time.Second)
+	if err := c.RetryPipeline(context.Background(), srv.URL+"/team/api/-/pipelines/7"); err != nil {
+		t.Fatal(err)
+	}
+	if got != "POST /api/v4/projects/team%2Fapi/pipelines/7/retry" {
+		t.Errorf("unexpected request %q", got)
+	}
+
+	if err := c.RetryPipeline(context.Background(), "https://other.example/team/api/-/pipelines/7"); !errors.Is(err, domain.ErrForeignPipeline) {
+		t.Errorf("expected ErrForeignPipeline, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package gitlab_http
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+)
+
+const pageSize = 100
+
+// getAll follows GitLab's page/per_page pagination until a short page.
+func getAll[T any](ctx context.Context, c *Client, endpoint string, q url.Values) ([]T, error) {
+	var out []T
+	for page := 1; ; page++ {
+		q.Set("per_page", strconv.Itoa(pageSize))
+		q.Set("page", strconv.Itoa(page))
+
+		var list []T
+		if err := retry(ctx, func() error {
+			return c.getJSON(ctx, c.baseUrl+endpoint+"?"+q.Encode(), &list)
+		}); err != nil {
+			return nil, err
+		}
+		out = append(out, list...)
+
+		if len(list) < pageSize {
+			return out, nil
+		}
+	}
+}
+
+type mergeRequestDTO struct {
+	IID          int64  `json:"iid"`
+	ProjectID    int64  `json:"project_id"`
+	SourceBranch string `json:"source_branch"`
+	References   struct {
+		Full string `json:"full"`
+	} `json:"references"`
+}
+
+// OpenMergeRequests returns a ref for every open merge request matching
+// any of scopes (e.g. "created_by_me", "assigned_to_me"), across projects.
+func (c *Client) OpenMergeRequests(ctx context.Context, scopes []string) ([]domain.ProjectRef, error) {
+	seen := make(map[domain.ProjectRef]struct{})
+	var out []domain.ProjectRef
+
+	for _, scope := range scopes {
+		list, err := getAll[mergeRequestDTO](ctx, c, "/api/v4/merge_requests", url.Values{
+			"state": {"opened"},
+			"scope": {scope},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, mr := range list {
+			pr := domain.ProjectRef{
+				ProjectID:    mr.ProjectID,
+				Ref:          mr.SourceBranch,
+				Name:         mr.References.Full,
+				MergeRequest: mr.IID,
+			}
+			if _, ok := seen[pr]; !ok {
+				seen[pr] = struct{}{}
+				out = append(out, pr)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+type groupProjectDTO struct {
+	ID                int64  `json:"id"`
+	Path              string `json:"path"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	DefaultBranch     string `json:"default_branch"`
+}
+
+// GroupProjects returns a ref to the default branch of every project in
+// group and its subgroups. Archived projects are skipped unless archived is
+// set; empty repositories, which have no default branch, always are.
+func (c *Client) GroupProjects(ctx context.Context, group string, archived bool) ([]domain.ProjectRef, error) {
+	q := url.Values{"include_subgroups": {"true"}, "order_by": {"id"}}
+	if !archived {
+		q.Set("archived", "false")
+	}
+
+	endpoint := "/api/v4/groups/" + strings.ReplaceAll(url.PathEscape(group), "/", "%2F") + "/projects"
+	list, err := getAll[groupProjectDTO](ctx, c, endpoint, q)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]domain.ProjectRef, 0, len(list))
+	for _, p := range list {
+		if p.DefaultBranch == "" {
+			continue
+		}
+		out = append(out, domain.ProjectRef{
+			ProjectID: p.ID,
+			Path:      p.PathWithNamespace,
+			Ref:       p.DefaultBranch,
+			Name:      p.Path,
+		})
+	}
+	return out, nil
+}
+
+// Branches returns the names of pr's branches matching its Ref, a glob
+// (see domain.MatchRef).
+func (c *Client) Branches(ctx context.Context, pr domain.ProjectRef) ([]string, error) {
+	pr, err := c.resolve(ctx, pr)
+	if err != nil {
+		return nil, err
+	}
+	pattern := pr.Ref
+
+	q := url.Values{}
+	if prefix := domain.RefPatternPrefix(pattern); prefix != "" {
+		q.Set("search", "^"+prefix)
+	}
+
+	list, err := getAll[struct {
+		Name string `json:"name"`
+	}](ctx, c, fmt.Sprintf("/api/v4/projects/%d/repository/branches", pr.ProjectID), q)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, b := range list {
+		if domain.MatchRef(pattern, b.Name) {
+			out = append(out, b.Name)
+		}
+	}
+	return out, nil
+}
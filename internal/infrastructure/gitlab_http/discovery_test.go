@@ -0,0 +1,106 @@
+package gitlab_http
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+)
+
+func TestBranches_PaginatesAndMatchesGlob(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/42/repository/branches", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("search"); got != "^release/" {
+			t.Errorf("expected prefix search, got %q", got)
+		}
+		if r.URL.Query().Get("page") == "1" {
+			names := make([]string, 0, pageSize)
+			for i := 0; i < pageSize-1; i++ {
+				names = append(names, fmt.Sprintf(`{"name":"release/old-%d"}`, i))
+			}
+			names = append(names, `{"name":"release/1.0"}`)
+			_, _ = w.Write([]byte("[" + strings.Join(names, ",") + "]"))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"name":"release/2.0/hotfix"},{"name":"release"}]`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL, "tok", time.Second)
+	got, err := c.Branches(context.Background(), domain.ProjectRef{ProjectID: 42, Ref: "release/*.?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"release/1.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	all, err := c.Branches(context.Background(), domain.ProjectRef{ProjectID: 42, Ref: "release/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != pageSize+1 {
+		t.Errorf("expected %d branches across pages, got %d", pageSize+1, len(all))
+	}
+}
+
+func TestMatchRef(t *testing.T) {
+	cases := []struct {
+		pattern, ref string
+		want         bool
+	}{
+		{"*", "main", true},
+		{"*", "feature/x", true},
+		{"release/*", "release/1.2", true},
+		{"release/*", "release", false},
+		{"v?.*", "v1.2", true},
+		{"v?.*", "v10.2", false},
+		{"main", "main", true},
+	}
+	for _, c := range cases {
+		if got := domain.MatchRef(c.pattern, c.ref); got != c.want {
+			t.Errorf("MatchRef(%q, %q) = %t, want %t", c.pattern, c.ref, got, c.want)
+		}
+	}
+}
+
+func TestGroupProjects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/groups/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/v4/groups/org%2Fteam/projects" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("archived") != "false" || q.Get("include_subgroups") != "true" {
+			t.Errorf("unexpected query %q", r.URL.RawQuery)
+		}
+		_, _ = w.Write([]byte(`[
+			{"id":1,"path":"api","path_with_namespace":"org/team/api","default_branch":"main"},
+			{"id":2,"path":"empty","path_with_namespace":"org/team/empty","default_branch":null},
+			{"id":3,"path":"web","path_with_namespace":"org/team/sub/web","default_branch":"master"}
+		]`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := New(srv.URL, "tok", time.Second)
+	refs, err := c.GroupProjects(context.Background(), "org/team", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []domain.ProjectRef{
+		{ProjectID: 1, Path: "org/team/api", Ref: "main", Name: "api"},
+		{ProjectID: 3, Path: "org/team/sub/web", Ref: "master", Name: "web"},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("unexpected refs %+v", refs)
+	}
+}
@@ -0,0 +1,78 @@
+package gitlab_http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Transport configures how the client reaches a self-managed GitLab.
+type Transport struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile string
+	// CertFile and KeyFile are a client certificate for mutual TLS.
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	// ProxyURL overrides the HTTPS_PROXY/HTTP_PROXY/NO_PROXY environment.
+	ProxyURL string
+}
+
+func (t Transport) build() (*http.Transport, error) {
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if t.ProxyURL != "" {
+		u, err := url.Parse(t.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_url: %w", err)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+
+	if t.CAFile == "" && t.CertFile == "" && t.KeyFile == "" && !t.InsecureSkipVerify {
+		return tr, nil
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("ca_file: no certificates found in " + t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, errors.New("cert_file and key_file must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	tr.TLSClientConfig = cfg
+	return tr, nil
+}
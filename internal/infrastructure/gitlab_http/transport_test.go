@@ -0,0 +1,136 @@
+package gitlab_http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+)
+
+func pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(`[{"id":1,"ref":"main","status":"success","web_url":"u"}]`))
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func latest(c *Client) error {
+	_, err := c.LatestPipeline(context.Background(), domain.ProjectRef{ProjectID: 1, Ref: "main"})
+	return err
+}
+
+func TestTransport_CAFileAndInsecure(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(pipelineHandler))
+	defer srv.Close()
+
+	if err := latest(New(srv.URL, "tok", time.Second)); err == nil {
+		t.Fatal("expected an untrusted certificate to be rejected")
+	}
+
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	c, err := NewWithTransport(srv.URL, "tok", time.Second, Transport{CAFile: ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := latest(c); err != nil {
+		t.Errorf("expected ca_file to be trusted: %v", err)
+	}
+
+	c, _ = NewWithTransport(srv.URL, "tok", time.Second, Transport{InsecureSkipVerify: true})
+	if err := latest(c); err != nil {
+		t.Errorf("expected insecure_skip_verify to connect: %v", err)
+	}
+
+	if _, err := NewWithTransport(srv.URL, "tok", time.Second, Transport{CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("expected error for a missing ca_file")
+	}
+}
+
+func TestTransport_ClientCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ci-watcher"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(pipelineHandler))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+
+	c, _ := NewWithTransport(srv.URL, "tok", time.Second, Transport{CAFile: ca})
+	if err := latest(c); err == nil {
+		t.Fatal("expected the server to require a client certificate")
+	}
+
+	c, err = NewWithTransport(srv.URL, "tok", time.Second, Transport{
+		CAFile:   ca,
+		CertFile: writePEM(t, "client.pem", "CERTIFICATE", der),
+		KeyFile:  writePEM(t, "client-key.pem", "PRIVATE KEY", keyDER),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := latest(c); err != nil {
+		t.Errorf("expected client certificate to be accepted: %v", err)
+	}
+}
+
+func TestTransport_ProxyURL(t *testing.T) {
+	var host string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.URL.Host
+		pipelineHandler(w, r)
+	}))
+	defer proxy.Close()
+
+	c, err := NewWithTransport("http://gitlab.example.invalid", "tok", time.Second, Transport{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := latest(c); err != nil {
+		t.Fatal(err)
+	}
+	if host != "gitlab.example.invalid" {
+		t.Errorf("expected request for gitlab host through the proxy, got %q", host)
+	}
+}
@@ -0,0 +1,55 @@
+// Package keyring_secrettool keeps secrets in the desktop keyring (GNOME
+// Keyring, KWallet, KeePassXC) through the Secret Service, using libsecret's
+// secret-tool.
+package keyring_secrettool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const service = "ci-watcher"
+
+// ErrNotFound is returned when the keyring holds no secret for the account.
+var ErrNotFound = errors.New("no secret in keyring")
+
+// Lookup returns the secret stored for account.
+func Lookup(ctx context.Context, account string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "secret-tool", "lookup", "service", service, "account", account)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err := cmd.Run(); err != nil {
+		// secret-tool exits 1 without output when nothing matches.
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && stderr.Len() == 0 {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("secret-tool lookup: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	secret := strings.TrimRight(stdout.String(), "\r\n")
+	if secret == "" {
+		return "", ErrNotFound
+	}
+	return secret, nil
+}
+
+// Store saves secret for account, replacing any previous one.
+func Store(ctx context.Context, account, secret string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "secret-tool", "store",
+		"--label=ci-watcher GitLab token ("+account+")",
+		"service", service, "account", account)
+	cmd.Stdin = strings.NewReader(secret)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("secret-tool store: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
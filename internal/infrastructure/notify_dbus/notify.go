@@ -0,0 +1,267 @@
+// Package notify_dbus shows notifications through the freedesktop
+// org.freedesktop.Notifications D-Bus service, with clickable actions.
+package notify_dbus
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	busName   = "org.freedesktop.Notifications"
+	busPath   = dbus.ObjectPath("/org/freedesktop/Notifications")
+	busIface  = "org.freedesktop.Notifications"
+	appName   = "ci-watcher"
+	maxActive = 256
+
+	defaultRetryTimeout = 10 * time.Second
+
+	actionDefault = "default"
+	actionOpen    = "open"
+	actionRetry   = "retry"
+)
+
+type Options struct {
+	// Open launches a pipeline URL; by default with xdg-open.
+	Open func(url string) error
+	// Retry restarts the pipeline at url; without it no Retry action is
+	// offered.
+	Retry func(ctx context.Context, url string) error
+	// RetryTimeout bounds each Retry, which runs in the background; 10s
+	// when zero.
+	RetryTimeout time.Duration
+	// OnError reports failures of actions run in the background.
+	OnError func(action, url string, err error)
+}
+
+// Notifier keeps one popup per pipeline URL: a later notification for the
+// same pipeline replaces the earlier one instead of stacking.
+type Notifier struct {
+	conn *dbus.Conn
+	obj  dbus.BusObject
+	opt  Options
+
+	mu   sync.Mutex
+	ids  map[string]uint32
+	urls map[uint32]string
+
+	signals chan *dbus.Signal
+	done    chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New connects to the session bus.
+func New(opt Options) (*Notifier, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+	n, err := NewWithConn(conn, opt)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// NewWithConn uses an existing bus connection, which Close then closes.
+func NewWithConn(conn *dbus.Conn, opt Options) (*Notifier, error) {
+	if opt.Open == nil {
+		opt.Open = xdgOpen
+	}
+	if opt.RetryTimeout <= 0 {
+		opt.RetryTimeout = defaultRetryTimeout
+	}
+
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(busPath),
+		dbus.WithMatchInterface(busIface),
+	); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		ctx:     ctx,
+		cancel:  cancel,
+		conn:    conn,
+		obj:     conn.Object(busName, busPath),
+		opt:     opt,
+		ids:     make(map[string]uint32),
+		urls:    make(map[uint32]string),
+		signals: make(chan *dbus.Signal, 16),
+		done:    make(chan struct{}),
+	}
+	conn.Signal(n.signals)
+	go n.listen()
+
+	return n, nil
+}
+
+// Close cancels running retries and waits for them to return.
+func (n *Notifier) Close() error {
+	n.conn.RemoveSignal(n.signals)
+	close(n.done)
+	n.cancel()
+	n.wg.Wait()
+	return n.conn.Close()
+}
+
+func (n *Notifier) Notify(ctx context.Context, note domain.Notification) error {
+	url := note.URL
+	var actions []string
+	if url != "" {
+		actions = []string{actionDefault, "Open", actionOpen, "Open"}
+		if note.Retryable && n.opt.Retry != nil {
+			actions = append(actions, actionRetry, "Retry")
+		}
+	}
+
+	n.mu.Lock()
+	replaces := n.ids[url]
+	n.mu.Unlock()
+
+	var id uint32
+	err := n.obj.CallWithContext(ctx, busIface+".Notify", 0,
+		appName, replaces, note.Icon, note.Title, escape(note.Body), actions,
+		hints(note), expireTimeout(note),
+	).Store(&id)
+	if err != nil {
+		return err
+	}
+
+	if url != "" {
+		n.mu.Lock()
+		if len(n.urls) >= maxActive {
+			clear(n.ids)
+			clear(n.urls)
+		}
+		if replaces != 0 && replaces != id {
+			delete(n.urls, replaces)
+		}
+		n.ids[url] = id
+		n.urls[id] = url
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+func (n *Notifier) listen() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case sig, ok := <-n.signals:
+			if !ok {
+				return
+			}
+			n.handle(sig)
+		}
+	}
+}
+
+func (n *Notifier) handle(sig *dbus.Signal) {
+	if len(sig.Body) < 2 {
+		return
+	}
+	id, ok := sig.Body[0].(uint32)
+	if !ok {
+		return
+	}
+
+	n.mu.Lock()
+	url, known := n.urls[id]
+	if sig.Name == busIface+".NotificationClosed" && known {
+		delete(n.urls, id)
+		if n.ids[url] == id {
+			delete(n.ids, url)
+		}
+	}
+	n.mu.Unlock()
+
+	if !known || sig.Name != busIface+".ActionInvoked" {
+		return
+	}
+
+	action, _ := sig.Body[1].(string)
+	switch action {
+	case actionDefault, actionOpen:
+		n.report(action, url, n.opt.Open(url))
+	case actionRetry:
+		if n.opt.Retry != nil {
+			n.wg.Add(1)
+			go n.retry(url)
+		}
+	}
+}
+
+// retry runs off the signal loop so a slow GitLab does not hold up later
+// clicks and closes.
+func (n *Notifier) retry(url string) {
+	defer n.wg.Done()
+	ctx, cancel := context.WithTimeout(n.ctx, n.opt.RetryTimeout)
+	defer cancel()
+	if err := n.opt.Retry(ctx, url); n.ctx.Err() == nil {
+		n.report(actionRetry, url, err)
+	}
+}
+
+func (n *Notifier) report(action, url string, err error) {
+	if err != nil && n.opt.OnError != nil {
+		n.opt.OnError(action, url, err)
+	}
+}
+
+func hints(note domain.Notification) map[string]dbus.Variant {
+	h := map[string]dbus.Variant{}
+	switch note.Severity {
+	case domain.SeverityLow:
+		h["urgency"] = dbus.MakeVariant(byte(0))
+	case domain.SeverityNormal:
+		h["urgency"] = dbus.MakeVariant(byte(1))
+	case domain.SeverityCritical:
+		h["urgency"] = dbus.MakeVariant(byte(2))
+	}
+	if note.Category != "" {
+		h["category"] = dbus.MakeVariant(note.Category)
+	}
+	if note.Silent {
+		h["suppress-sound"] = dbus.MakeVariant(true)
+		h["transient"] = dbus.MakeVariant(true)
+	}
+	return h
+}
+
+// expireTimeout is in milliseconds: -1 lets the server decide, 0 never
+// expires.
+func expireTimeout(note domain.Notification) int32 {
+	switch {
+	case note.Sticky:
+		return 0
+	case note.Expire > 0:
+		return int32(note.Expire / time.Millisecond)
+	default:
+		return -1
+	}
+}
+
+func xdgOpen(url string) error {
+	cmd := exec.Command("xdg-open", url)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() { _ = cmd.Wait() }()
+	return nil
+}
+
+// escape protects bodies from servers that interpret markup.
+var escape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
@@ -0,0 +1,252 @@
+package notify_dbus
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+	"github.com/godbus/dbus/v5"
+)
+
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:tmpdir=/tmp</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>`
+
+// privateBus starts a throwaway dbus-daemon and returns its address.
+func privateBus(t *testing.T) string {
+	t.Helper()
+
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+	conf := filepath.Join(t.TempDir(), "bus.conf")
+	if err := os.WriteFile(conf, []byte(busConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+conf, "--print-address=1", "--nofork")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	addr, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(addr)
+}
+
+type call struct {
+	replaces uint32
+	icon     string
+	summary  string
+	body     string
+	actions  []string
+	hints    map[string]dbus.Variant
+	expire   int32
+}
+
+// server is a fake notification daemon.
+type server struct {
+	mu    sync.Mutex
+	calls []call
+	next  uint32
+}
+
+func (s *server) Notify(_ string, replaces uint32, icon, summary, body string, actions []string,
+	hints map[string]dbus.Variant, expire int32) (uint32, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call{replaces, icon, summary, body, actions, hints, expire})
+	if replaces != 0 {
+		return replaces, nil
+	}
+	s.next++
+	return s.next, nil
+}
+
+func (s *server) last() call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[len(s.calls)-1]
+}
+
+func connect(t *testing.T, addr string) *dbus.Conn {
+	t.Helper()
+	conn, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// fakeDaemon starts a private bus with a fake notification daemon on it and
+// returns the bus address and the daemon's connection.
+func fakeDaemon(t *testing.T) (string, *dbus.Conn, *server) {
+	t.Helper()
+	addr := privateBus(t)
+
+	srvConn := connect(t, addr)
+	t.Cleanup(func() { _ = srvConn.Close() })
+	srv := &server{}
+	if err := srvConn.Export(srv, busPath, busIface); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := srvConn.RequestName(busName, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("request name: %v %v", reply, err)
+	}
+	return addr, srvConn, srv
+}
+
+func TestNotifier_ActionsAndReplace(t *testing.T) {
+	addr, srvConn, srv := fakeDaemon(t)
+
+	opened := make(chan string, 1)
+	retried := make(chan string, 1)
+	n, err := NewWithConn(connect(t, addr), Options{
+		Open:  func(url string) error { opened <- url; return nil },
+		Retry: func(_ context.Context, url string) error { retried <- url; return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = n.Close() }()
+
+	ctx := context.Background()
+	const url = "https://gl/p/7"
+
+	running := domain.Notification{
+		Title: "▶️ CI: running", Body: "a <b> & c", URL: url, Status: domain.StatusRunning,
+		NotificationStyle: domain.NotificationStyle{Severity: domain.SeverityLow, Silent: true},
+	}
+	if err := n.Notify(ctx, running); err != nil {
+		t.Fatal(err)
+	}
+	first := srv.last()
+	if first.replaces != 0 || first.body != "a &lt;b&gt; &amp; c" || first.expire != -1 {
+		t.Errorf("unexpected first notification %+v", first)
+	}
+	if strings.Join(first.actions, ",") != "default,Open,open,Open" {
+		t.Errorf("expected no retry for a running pipeline, got %v", first.actions)
+	}
+	if first.hints["suppress-sound"].Value() != true || first.hints["urgency"].Value() != byte(0) {
+		t.Errorf("unexpected hints %v", first.hints)
+	}
+
+	_ = n.Notify(ctx, domain.Notification{
+		Title: "❌ CI: failed", Body: "boom", URL: url, Status: domain.StatusFailed, Retryable: true,
+		Category:          "x-ci-watcher.failed",
+		NotificationStyle: domain.NotificationStyle{Severity: domain.SeverityCritical, Sticky: true, Icon: "dialog-error"},
+	})
+	failed := srv.last()
+	if failed.replaces != 1 || failed.expire != 0 || failed.icon != "dialog-error" {
+		t.Errorf("expected a sticky popup replacing 1, got %+v", failed)
+	}
+	if strings.Join(failed.actions, ",") != "default,Open,open,Open,retry,Retry" {
+		t.Errorf("unexpected actions %v", failed.actions)
+	}
+	if failed.hints["urgency"].Value() != byte(2) || failed.hints["category"].Value() != "x-ci-watcher.failed" {
+		t.Errorf("unexpected hints %v", failed.hints)
+	}
+
+	_ = srvConn.Emit(busPath, busIface+".ActionInvoked", uint32(1), "open")
+	_ = srvConn.Emit(busPath, busIface+".ActionInvoked", uint32(1), "retry")
+	for _, ch := range []chan string{opened, retried} {
+		select {
+		case got := <-ch:
+			if got != url {
+				t.Errorf("action for wrong url %q", got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("action not handled")
+		}
+	}
+
+	_ = srvConn.Emit(busPath, busIface+".NotificationClosed", uint32(1), uint32(2))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n.mu.Lock()
+		_, tracked := n.ids[url]
+		n.mu.Unlock()
+		if !tracked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed notification still tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = n.Notify(ctx, domain.Notification{
+		Title: "✅ CI: success", URL: url, Status: domain.StatusSuccess,
+		NotificationStyle: domain.NotificationStyle{Expire: 5 * time.Second},
+	})
+	if got := srv.last(); got.replaces != 0 || got.expire != 5000 {
+		t.Errorf("expected a fresh expiring popup after close, got %+v", got)
+	}
+}
+
+func TestNotifier_SlowRetryDoesNotBlockActions(t *testing.T) {
+	addr, srvConn, _ := fakeDaemon(t)
+
+	opened := make(chan string, 1)
+	failed := make(chan error, 1)
+	n, err := NewWithConn(connect(t, addr), Options{
+		Open: func(url string) error { opened <- url; return nil },
+		Retry: func(ctx context.Context, _ string) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		RetryTimeout: time.Second,
+		OnError:      func(_, _ string, err error) { failed <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = n.Close() }()
+
+	const url = "https://gl/p/7"
+	_ = n.Notify(context.Background(), domain.Notification{Title: "❌ CI: failed", URL: url, Retryable: true})
+
+	_ = srvConn.Emit(busPath, busIface+".ActionInvoked", uint32(1), "retry")
+	_ = srvConn.Emit(busPath, busIface+".ActionInvoked", uint32(1), "open")
+
+	select {
+	case <-opened:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("open waited for the retry")
+	}
+	select {
+	case err := <-failed:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected the retry to time out, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("retry not bounded by RetryTimeout")
+	}
+}
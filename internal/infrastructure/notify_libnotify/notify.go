@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/davarch/ci-watcher/internal/domain"
 )
 
 type Notifier struct {
@@ -15,26 +17,8 @@ type Notifier struct {
 func New() *Notifier     { return &Notifier{soft: false} }
 func NewSoft() *Notifier { return &Notifier{soft: true} }
 
-type Options struct {
-	Urgency string
-	Expire  time.Duration
-}
-
-func (n *Notifier) Notify(ctx context.Context, title, body, url string) error {
-	if strings.TrimSpace(url) != "" {
-		if body == "" {
-			body = url
-		} else {
-			body = body + "\n" + url
-		}
-	}
-
-	args := []string{
-		"--app-name=ci-watcher",
-		title, body,
-	}
-
-	cmd := exec.CommandContext(ctx, "notify-send", args...)
+func (n *Notifier) Notify(ctx context.Context, note domain.Notification) error {
+	cmd := exec.CommandContext(ctx, "notify-send", args(note)...)
 	if err := cmd.Run(); err != nil {
 		if n.soft {
 			return nil
@@ -44,32 +28,34 @@ func (n *Notifier) Notify(ctx context.Context, title, body, url string) error {
 	return nil
 }
 
-func (n *Notifier) NotifyWith(ctx context.Context, title, body, url string, opt Options) error {
-	if strings.TrimSpace(url) != "" {
+func args(note domain.Notification) []string {
+	body := note.Body
+	if strings.TrimSpace(note.URL) != "" {
 		if body == "" {
-			body = url
+			body = note.URL
 		} else {
-			body = body + "\n" + url
+			body = body + "\n" + note.URL
 		}
 	}
 
 	args := []string{"--app-name=ci-watcher"}
-	if opt.Urgency != "" {
-		args = append(args, "--urgency="+opt.Urgency)
+	if note.Severity != "" {
+		args = append(args, "--urgency="+string(note.Severity))
 	}
-	if opt.Expire > 0 {
-		ms := strconv.Itoa(int(opt.Expire / time.Millisecond))
-		args = append(args, "--expire-time="+ms)
+	switch {
+	case note.Sticky:
+		args = append(args, "--expire-time=0")
+	case note.Expire > 0:
+		args = append(args, "--expire-time="+strconv.Itoa(int(note.Expire/time.Millisecond)))
 	}
-	args = append(args, title, body)
-
-	cmd := exec.CommandContext(ctx, "notify-send", args...)
-	if err := cmd.Run(); err != nil {
-		if n.soft {
-			return nil
-		}
-		return err
+	if note.Icon != "" {
+		args = append(args, "--icon="+note.Icon)
 	}
-
-	return nil
+	if note.Category != "" {
+		args = append(args, "--category="+note.Category)
+	}
+	if note.Silent {
+		args = append(args, "--hint=boolean:suppress-sound:true", "--hint=boolean:transient:true")
+	}
+	return append(args, note.Title, body)
 }
@@ -0,0 +1,228 @@
+// Package notify_webhook POSTs notifications as JSON to HTTP endpoints,
+// e.g. home automation or chat bots.
+package notify_webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/davarch/ci-watcher/internal/domain"
+)
+
+const (
+	defaultTimeout    = 10 * time.Second
+	defaultMaxElapsed = time.Minute
+	queueSize         = 64
+
+	HeaderEvent     = "X-CI-Watcher-Event"
+	HeaderSignature = "X-CI-Watcher-Signature"
+)
+
+// ErrQueueFull is returned when a target has too many pending deliveries.
+var ErrQueueFull = errors.New("webhook queue full")
+
+// Target is an endpoint to POST to.
+type Target struct {
+	URL string
+	// Secret signs the body with HMAC-SHA256 in HeaderSignature.
+	Secret string
+	// Timeout bounds each attempt; 10s when zero.
+	Timeout time.Duration
+	Headers map[string]string
+}
+
+type Options struct {
+	// MaxElapsed bounds the retries of one delivery; 1m when zero.
+	MaxElapsed time.Duration
+	// Transport defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+	// OnError reports deliveries that failed for good.
+	OnError func(url string, err error)
+}
+
+// Payload is the JSON body of every request.
+type Payload struct {
+	Event     string `json:"event"`
+	Project   string `json:"project,omitempty"`
+	Ref       string `json:"ref,omitempty"`
+	Pipeline  int64  `json:"pipeline,omitempty"`
+	Status    string `json:"status"`
+	URL       string `json:"url,omitempty"`
+	Author    string `json:"author,omitempty"`
+	SHA       string `json:"sha,omitempty"`
+	Title     string `json:"title"`
+	Message   string `json:"message,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Notifier delivers in the background, one queue per target, so a slow
+// endpoint delays neither polling nor the other targets.
+type Notifier struct {
+	opt     Options
+	targets []*target
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type target struct {
+	Target
+	hc    *http.Client
+	queue chan delivery
+}
+
+type delivery struct {
+	event string
+	body  []byte
+}
+
+func New(targets []Target, opt Options) *Notifier {
+	if opt.MaxElapsed <= 0 {
+		opt.MaxElapsed = defaultMaxElapsed
+	}
+	if opt.Transport == nil {
+		opt.Transport = http.DefaultTransport
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{opt: opt, ctx: ctx, cancel: cancel}
+	for _, t := range targets {
+		if t.Timeout <= 0 {
+			t.Timeout = defaultTimeout
+		}
+		tg := &target{
+			Target: t,
+			hc:     &http.Client{Timeout: t.Timeout, Transport: opt.Transport},
+			queue:  make(chan delivery, queueSize),
+		}
+		n.targets = append(n.targets, tg)
+
+		n.wg.Add(1)
+		go n.work(tg)
+	}
+	return n
+}
+
+// Close drops pending deliveries and waits for the workers to stop.
+func (n *Notifier) Close() error {
+	n.cancel()
+	n.wg.Wait()
+	return nil
+}
+
+func (n *Notifier) Notify(ctx context.Context, note domain.Notification) error {
+	p := Payload{
+		Event:     string(note.Event),
+		Project:   note.Project,
+		Ref:       note.Pipeline.Ref,
+		Pipeline:  note.Pipeline.ID,
+		Status:    string(note.Status),
+		URL:       note.URL,
+		Author:    note.Pipeline.Author,
+		SHA:       note.Pipeline.SHA,
+		Title:     note.Title,
+		Message:   note.Body,
+		Timestamp: time.Now().Unix(),
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, t := range n.targets {
+		select {
+		case t.queue <- delivery{event: p.Event, body: body}:
+		default:
+			errs = append(errs, fmt.Errorf("%s: %w", t.URL, ErrQueueFull))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) work(t *target) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case d := <-t.queue:
+			if err := n.deliver(t, d); err != nil && n.ctx.Err() == nil && n.opt.OnError != nil {
+				n.opt.OnError(t.URL, err)
+			}
+		}
+	}
+}
+
+func (n *Notifier) deliver(t *target, d delivery) error {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = 300 * time.Millisecond
+	bo.MaxInterval = 10 * time.Second
+	bo.MaxElapsedTime = n.opt.MaxElapsed
+
+	return backoff.Retry(func() error { return t.post(n.ctx, d) }, backoff.WithContext(bo, n.ctx))
+}
+
+// post sends d once. Errors are shaped for retry: 4xx other than 408 and
+// 429 are permanent.
+func (t *target) post(ctx context.Context, d delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ci-watcher")
+	req.Header.Set(HeaderEvent, d.event)
+	if t.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(t.Secret, d.body))
+	}
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout:
+		if sec, _ := strconv.Atoi(resp.Header.Get("Retry-After")); sec > 0 {
+			select {
+			case <-time.After(time.Duration(sec) * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return fmt.Errorf("webhook %s", resp.Status)
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("webhook %s", resp.Status)
+	default:
+		return backoff.Permanent(fmt.Errorf("webhook %s", resp.Status))
+	}
+}
+
+// Sign returns the HeaderSignature value for body: "sha256=" and the hex
+// HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,133 @@
+package notify_webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+)
+
+var failed = domain.Notification{
+	Title:   "❌ CI: failed",
+	Body:    "core · Pipeline #7 (main)",
+	URL:     "https://gl/core/-/pipelines/7",
+	Project: "core",
+	Status:  domain.StatusFailed,
+	Event:   domain.EventFailed,
+	Pipeline: domain.Pipeline{
+		ID: 7, Ref: "main", Status: domain.StatusFailed, SHA: "abc123", Author: "Alice",
+	},
+}
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+func TestNotify_PostsSignedPayload(t *testing.T) {
+	got := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- request{r.Header, b}
+	}))
+	defer srv.Close()
+
+	n := New([]Target{{URL: srv.URL, Secret: "s3cret", Headers: map[string]string{"X-Bot": "ha"}}}, Options{})
+	defer func() { _ = n.Close() }()
+
+	if err := n.Notify(context.Background(), failed); err != nil {
+		t.Fatal(err)
+	}
+
+	var req request
+	select {
+	case req = <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook not called")
+	}
+
+	if sig := req.header.Get(HeaderSignature); sig != Sign("s3cret", req.body) {
+		t.Errorf("bad signature %q", sig)
+	}
+	if req.header.Get(HeaderEvent) != "failed" || req.header.Get("X-Bot") != "ha" || req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected headers %v", req.header)
+	}
+
+	var p Payload
+	if err := json.Unmarshal(req.body, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Project != "core" || p.Ref != "main" || p.Pipeline != 7 || p.Status != "failed" ||
+		p.URL != failed.URL || p.Author != "Alice" || p.SHA != "abc123" || p.Timestamp == 0 {
+		t.Errorf("unexpected payload %+v", p)
+	}
+}
+
+func TestNotify_RetriesServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		close(done)
+	}))
+	defer srv.Close()
+
+	n := New([]Target{{URL: srv.URL}}, Options{MaxElapsed: 5 * time.Second})
+	defer func() { _ = n.Close() }()
+	_ = n.Notify(context.Background(), failed)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a retry, got %d calls", calls.Load())
+	}
+}
+
+func TestNotify_PermanentErrorsAndTimeout(t *testing.T) {
+	var rejected atomic.Int32
+	reject := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rejected.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer reject.Close()
+
+	stall := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stall:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(stall)
+
+	errs := make(chan string, 2)
+	n := New([]Target{{URL: reject.URL}, {URL: slow.URL, Timeout: 50 * time.Millisecond}}, Options{
+		MaxElapsed: 200 * time.Millisecond,
+		OnError:    func(url string, err error) { errs <- url },
+	})
+	defer func() { _ = n.Close() }()
+	_ = n.Notify(context.Background(), failed)
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		select {
+		case u := <-errs:
+			seen[u] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected both targets to fail, got %v", seen)
+		}
+	}
+	if n := rejected.Load(); n != 1 {
+		t.Errorf("expected a 401 not to be retried, got %d calls", n)
+	}
+}
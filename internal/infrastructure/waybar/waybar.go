@@ -0,0 +1,162 @@
+package waybar
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/davarch/ci-watcher/internal/domain"
+	"github.com/davarch/ci-watcher/internal/infrastructure/cache_fs"
+)
+
+const (
+	DefaultFormat        = `{{.OK}} ok{{if .Failed}} / {{.Failed}} failed{{end}}{{if .Running}} / {{.Running}} running{{end}}`
+	DefaultTooltipFormat = `{{range .Projects}}{{.Name}} ({{with .Tag}}{{.}}{{else}}{{.Ref}}{{end}}): {{.Status}} #{{.Pipeline}}` + "\n" + `{{end}}`
+	DefaultPausedFormat  = `paused`
+	DefaultEmptyFormat   = `no-ci`
+)
+
+type Options struct {
+	Format        string
+	TooltipFormat string
+	PausedFormat  string
+	EmptyFormat   string
+	Classes       map[string]string
+}
+
+// Output is the shape Waybar expects from a custom module with
+// "return-type": "json".
+type Output struct {
+	Text       string `json:"text"`
+	Class      string `json:"class"`
+	Tooltip    string `json:"tooltip"`
+	Percentage int    `json:"percentage"`
+}
+
+// Data is what templates are executed against.
+type Data struct {
+	Paused  bool
+	Worst   string
+	Total   int
+	OK      int
+	Failed  int
+	Running int
+	// Active counts pipelines that may still change (pending, running, ...).
+	Active   int
+	Counts   map[string]int
+	Projects []cache_fs.Entry
+}
+
+type Renderer struct {
+	text, tooltip, paused, empty *template.Template
+	classes                      map[string]string
+}
+
+func New(o Options) (*Renderer, error) {
+	parse := func(name, src, def string) (*template.Template, error) {
+		if src == "" {
+			src = def
+		}
+		return template.New(name).Parse(src)
+	}
+
+	var (
+		r   = &Renderer{classes: o.Classes}
+		err error
+	)
+	if r.text, err = parse("format", o.Format, DefaultFormat); err != nil {
+		return nil, err
+	}
+	if r.tooltip, err = parse("tooltip_format", o.TooltipFormat, DefaultTooltipFormat); err != nil {
+		return nil, err
+	}
+	if r.paused, err = parse("paused_format", o.PausedFormat, DefaultPausedFormat); err != nil {
+		return nil, err
+	}
+	if r.empty, err = parse("empty_format", o.EmptyFormat, DefaultEmptyFormat); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Render builds a Waybar line from the cache file. An empty File (zero
+// projects) renders the empty format with class "no-ci".
+func (r *Renderer) Render(f cache_fs.File, paused bool) (Output, error) {
+	d := Data{Paused: paused, Worst: f.Worst, Counts: f.Counts}
+
+	keys := make([]string, 0, len(f.Projects))
+	for k := range f.Projects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e := f.Projects[k]
+		if e.Name == "" {
+			e.Name = k
+		}
+		d.Projects = append(d.Projects, e)
+	}
+
+	d.Total = len(d.Projects)
+	d.OK = f.Counts["success"]
+	d.Failed = f.Counts["failed"]
+	d.Running = f.Counts["running"]
+	for st, n := range f.Counts {
+		if domain.PipelineStatus(st).Active() {
+			d.Active += n
+		}
+	}
+
+	var (
+		out  Output
+		text *template.Template
+	)
+	switch {
+	case paused:
+		text, out.Class = r.paused, r.class("paused")
+	case d.Total == 0:
+		text, out.Class = r.empty, r.class("no-ci")
+	default:
+		text, out.Class = r.text, r.class(f.Worst)
+	}
+
+	var err error
+	if out.Text, err = exec(text, d); err != nil {
+		return Output{}, err
+	}
+	if out.Tooltip, err = exec(r.tooltip, d); err != nil {
+		return Output{}, err
+	}
+	if d.Total > 0 {
+		out.Percentage = d.OK * 100 / d.Total
+	}
+
+	return out, nil
+}
+
+// Line renders and encodes a single JSON line (without trailing newline).
+func (r *Renderer) Line(f cache_fs.File, paused bool) ([]byte, error) {
+	out, err := r.Render(f, paused)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(out)
+}
+
+func (r *Renderer) class(status string) string {
+	if c, ok := r.classes[status]; ok {
+		return c
+	}
+	return status
+}
+
+func exec(t *template.Template, d Data) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, d); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(b.String(), "\n"), nil
+}
@@ -0,0 +1,85 @@
+package waybar
+
+import (
+	"testing"
+
+	"github.com/davarch/ci-watcher/internal/infrastructure/cache_fs"
+)
+
+func file() cache_fs.File {
+	return cache_fs.File{
+		Version: cache_fs.SchemaVersion,
+		Worst:   "failed",
+		Counts:  map[string]int{"success": 2, "failed": 1},
+		Projects: map[string]cache_fs.Entry{
+			"1:main": {Name: "core", Ref: "main", Pipeline: 10, Status: "success"},
+			"2:main": {Name: "api", Ref: "main", Pipeline: 20, Status: "failed"},
+			"3:dev":  {Name: "web", Ref: "dev", Pipeline: 30, Status: "success"},
+		},
+	}
+}
+
+func TestRender_DefaultFormat(t *testing.T) {
+	r, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := r.Render(file(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Text != "2 ok / 1 failed" {
+		t.Errorf("unexpected text %q", out.Text)
+	}
+	if out.Class != "failed" {
+		t.Errorf("unexpected class %q", out.Class)
+	}
+	if out.Tooltip != "core (main): success #10\napi (main): failed #20\nweb (dev): success #30" {
+		t.Errorf("unexpected tooltip %q", out.Tooltip)
+	}
+	if out.Percentage != 66 {
+		t.Errorf("unexpected percentage %d", out.Percentage)
+	}
+}
+
+func TestRender_ActiveCount(t *testing.T) {
+	f := file()
+	f.Counts["pending"] = 1
+	f.Counts["running"] = 2
+	r, _ := New(Options{Format: "{{.Active}} active"})
+	if out, _ := r.Render(f, false); out.Text != "3 active" {
+		t.Errorf("unexpected active text %q", out.Text)
+	}
+}
+
+func TestRender_PausedAndCustomClasses(t *testing.T) {
+	r, err := New(Options{
+		PausedFormat: "⏸ {{.Total}}",
+		Classes:      map[string]string{"paused": "idle", "failed": "bad"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := r.Render(file(), true)
+	if out.Text != "⏸ 3" || out.Class != "idle" {
+		t.Errorf("unexpected paused output %+v", out)
+	}
+
+	out, _ = r.Render(file(), false)
+	if out.Class != "bad" {
+		t.Errorf("expected class override, got %q", out.Class)
+	}
+
+	out, _ = r.Render(cache_fs.File{}, false)
+	if out.Text != "no-ci" || out.Class != "no-ci" {
+		t.Errorf("unexpected empty output %+v", out)
+	}
+}
+
+func TestNew_InvalidTemplate(t *testing.T) {
+	if _, err := New(Options{Format: "{{.Nope"}); err == nil {
+		t.Error("expected parse error")
+	}
+}